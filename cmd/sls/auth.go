@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+// Scopes requested by sls auth.
+var authScopes = []string{strava.ScopeRead, strava.ScopeActivityReadAll, strava.ScopeActivityWrite}
+
+// Path Strava redirects to once access is granted. In manual mode nothing
+// listens on it; the user copies the URL from the browser instead.
+const authRedirectPath = "/exchange_token"
+
+type authResult struct {
+	code  string
+	scope string
+	err   error
+}
+
+func authCommand() *command {
+	fs := newFlagSet("auth")
+	fs.Bool("manual", false, "paste the authorization code instead of running a local listener")
+	fs.Int("port", 0, "port for the local redirect listener (default random)")
+	return &command{
+		name:    "auth",
+		summary: "authorize sls to access your Strava account",
+		flags:   fs,
+		run:     auth,
+	}
+}
+
+func auth(ctx context.Context, s *sls, args []string) error {
+	var result authResult
+	if viper.GetBool("manual") {
+		result = authManual(s)
+	} else {
+		result = authListen(ctx, s, viper.GetInt("port"))
+	}
+	if result.err != nil {
+		return result.err
+	}
+
+	athlete, err := s.sc.Credentials().Exchange(ctx, result.code)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Authorized as %s %s (athlete %d); token written to %s\n",
+		athlete.Firstname, athlete.Lastname, athlete.Id, viper.GetString("token_path"))
+
+	checkScopes(result.scope)
+	if s.athleteId != athlete.Id {
+		fmt.Printf("Set athlete_id = %d in %s\n", athlete.Id, viper.ConfigFileUsed())
+	}
+	return nil
+}
+
+// authListen runs a loopback HTTP server to catch Strava's redirect.
+func authListen(ctx context.Context, s *sls, port int) authResult {
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return authResult{err: fmt.Errorf("couldn't start redirect listener: %w", err)}
+	}
+	redirectURI := fmt.Sprintf("http://127.0.0.1:%d%s", ln.Addr().(*net.TCPAddr).Port, authRedirectPath)
+
+	results := make(chan authResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(authRedirectPath, func(w http.ResponseWriter, r *http.Request) {
+		result := parseRedirect(r.URL.Query())
+		if result.err != nil {
+			http.Error(w, result.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "sls is authorized. You can close this window.")
+		}
+		select {
+		case results <- result:
+		default:
+		}
+	})
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	fmt.Printf("Open this URL in a browser to authorize sls:\n\n  %s\n\n",
+		s.sc.Credentials().AuthorizeURL(redirectURI, authScopes...))
+	fmt.Println("Waiting for Strava to redirect back (Ctrl-C to cancel)...")
+
+	select {
+	case result := <-results:
+		return result
+	case <-ctx.Done():
+		return authResult{err: ctx.Err()}
+	}
+}
+
+// authManual asks the user to paste the redirect URL (or just the code) for
+// machines where a browser can't reach a loopback listener.
+func authManual(s *sls) authResult {
+	redirectURI := "http://localhost" + authRedirectPath
+	fmt.Printf("Open this URL in a browser to authorize sls:\n\n  %s\n\n",
+		s.sc.Credentials().AuthorizeURL(redirectURI, authScopes...))
+	fmt.Println("The browser will then fail to load a localhost page. Paste its URL here:")
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return authResult{err: fmt.Errorf("couldn't read authorization code: %w", err)}
+	}
+	line = strings.TrimSpace(line)
+	if !strings.Contains(line, "code=") {
+		// A bare code; the granted scopes are unknown.
+		return authResult{code: line}
+	}
+
+	u, err := url.Parse(line)
+	if err != nil {
+		return authResult{err: fmt.Errorf("couldn't parse redirect URL: %w", err)}
+	}
+	return parseRedirect(u.Query())
+}
+
+func parseRedirect(q url.Values) authResult {
+	if e := q.Get("error"); e != "" {
+		return authResult{err: fmt.Errorf("authorization failed: %s", e)}
+	}
+	code := q.Get("code")
+	if code == "" {
+		return authResult{err: errors.New("redirect didn't include an authorization code")}
+	}
+	return authResult{code: code, scope: q.Get("scope")}
+}
+
+// checkScopes warns if the athlete didn't grant every scope sls asked for.
+func checkScopes(scope string) {
+	if scope == "" {
+		log.Warn("couldn't determine granted scopes; make sure activity:read_all was allowed")
+		return
+	}
+	granted := make(map[string]bool)
+	for _, s := range strings.Split(scope, ",") {
+		granted[s] = true
+	}
+	if !granted[strava.ScopeActivityReadAll] {
+		log.Warnf("granted scopes %q don't include %s; private activities won't be listed. "+
+			"Run sls auth again and allow viewing data about your private activities.",
+			scope, strava.ScopeActivityReadAll)
+	}
+	if !granted[strava.ScopeActivityWrite] {
+		log.Warnf("granted scopes %q don't include %s; sls edit and sls upload won't work. "+
+			"Run sls auth again and allow uploading activities and editing activity data.",
+			scope, strava.ScopeActivityWrite)
+	}
+}
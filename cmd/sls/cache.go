@@ -1,13 +1,79 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/markdrayton/sls/internal/atomicfile"
+	"github.com/markdrayton/sls/store"
+	"github.com/markdrayton/sls/strava"
 )
 
+// cacheVersion is the version of the envelope written around cached data.
+// Bump it when older versions mustn't write cached data, and add a
+// migration if existing data needs converting.
+const cacheVersion = 1
+
+// cacheMigrations[v] converts cached data from version v to v+1. Versions
+// without a migration need no conversion.
+var cacheMigrations = map[int]func(data json.RawMessage) (json.RawMessage, error){}
+
+type cacheEnvelope struct {
+	Version int             `json:"version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+var errCacheVersion = errors.New("written by a newer version of sls")
+
+// decodeCache unwraps cached data and brings it up to cacheVersion. Files
+// written before the envelope existed hold the data directly, as an array
+// or object, and are wrapped as version 1.
+func decodeCache(b []byte, data interface{}) error {
+	env, err := readEnvelope(b)
+	if err != nil {
+		return err
+	}
+	if env.Version > cacheVersion {
+		return fmt.Errorf("version %d: %w", env.Version, errCacheVersion)
+	}
+	for v := env.Version; v < cacheVersion; v++ {
+		if m := cacheMigrations[v]; m != nil {
+			env.Data, err = m(env.Data)
+			if err != nil {
+				return fmt.Errorf("couldn't migrate from version %d: %w", v, err)
+			}
+		}
+	}
+	return json.Unmarshal(env.Data, data)
+}
+
+// readEnvelope returns the envelope around cached data, making one for data
+// that predates it.
+func readEnvelope(b []byte) (cacheEnvelope, error) {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(b, &fields) == nil && fields["version"] != nil && fields["data"] != nil {
+		var env cacheEnvelope
+		err := json.Unmarshal(b, &env)
+		if err == nil && env.Version < 1 {
+			err = fmt.Errorf("invalid version %d", env.Version)
+		}
+		return env, err
+	}
+	if !json.Valid(b) {
+		return cacheEnvelope{}, errors.New("invalid JSON")
+	}
+	return cacheEnvelope{Version: 1, Data: b}, nil
+}
+
 func doReadCache(path string, data interface{}) error {
 	if path == "" {
 		return nil
@@ -21,18 +87,14 @@ func doReadCache(path string, data interface{}) error {
 			return err
 		}
 	}
+	defer f.Close()
 
 	b, err := io.ReadAll(f)
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(b, data)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return decodeCache(b, data)
 }
 
 func readCache(path string, data interface{}) error {
@@ -48,39 +110,244 @@ func doWriteCache(path string, data interface{}) error {
 		return nil
 	}
 
-	f, err := os.CreateTemp("", "sls")
+	b, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
-	tmpFile := f.Name()
-
-	b, err := json.Marshal(data)
+	b, err = json.Marshal(cacheEnvelope{cacheVersion, b})
 	if err != nil {
 		return err
 	}
 
-	_, err = f.Write(b)
+	return atomicfile.WriteFile(path, b, 0644)
+}
+
+func writeCache(path string, data interface{}) error {
+	err := doWriteCache(path, data)
+	if err != nil {
+		log.Printf("Couldn't write cache to %s: %s", path, err)
+	}
+	return err
+}
+
+func cacheCommand() *command {
+	return &command{
+		name:    "cache",
+		summary: "check and repair the caches (cache verify|repair|stats)",
+		flags:   newFlagSet("cache"),
+		offline: true,
+		verbs:   []string{"verify", "repair", "stats"},
+		run:     cache,
+	}
+}
+
+func cache(ctx context.Context, s *sls, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: sls cache verify|repair|stats")
+	}
+	switch args[0] {
+	case "verify":
+		return s.verifyCaches()
+	case "repair":
+		return s.repairCaches(ctx)
+	case "stats":
+		return s.cacheStats()
+	}
+	return errors.New("usage: sls cache verify|repair|stats")
+}
+
+// damagedFile is a detail or stream file that can't be read.
+type damagedFile struct {
+	path string
+	err  error
+}
+
+func (s *sls) verifyCaches() error {
+	report, err := s.store.Check()
 	if err != nil {
 		return err
 	}
+	problems := storeProblems(report)
+	damaged, err := s.damagedFiles()
+	if err != nil {
+		return err
+	}
+	for _, d := range damaged {
+		problems = append(problems, fmt.Sprintf("%s: %s", d.path, d.err))
+	}
 
-	err = f.Close()
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems; run sls cache repair to fix them", len(problems))
+	}
+	fmt.Println("No problems found")
+	return nil
+}
+
+// repairCaches fixes the problems verifyCaches finds. Damaged detail and
+// stream files are removed, to be fetched again when they're next needed,
+// and missing gear is fetched.
+func (s *sls) repairCaches(ctx context.Context) error {
+	report, err := s.store.Repair()
 	if err != nil {
 		return err
 	}
+	problems := storeProblems(report)
+	for _, p := range problems {
+		fmt.Println("fixed " + p)
+	}
 
-	err = os.Rename(tmpFile, path)
+	damaged, err := s.damagedFiles()
 	if err != nil {
 		return err
 	}
+	for _, d := range damaged {
+		err = os.Remove(d.path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %s: %s\n", d.path, d.err)
+	}
 
+	if len(report.OrphanedGear) > 0 && s.offline {
+		log.Printf("Run sls cache repair without --offline to fetch missing gear")
+	} else if len(report.OrphanedGear) > 0 {
+		_, err = s.gears(ctx, s.readActivityCache())
+		if err != nil {
+			return fmt.Errorf("couldn't fetch missing gear: %w", err)
+		}
+	}
+
+	if len(problems)+len(damaged) == 0 {
+		fmt.Println("No problems found")
+	}
 	return nil
 }
 
-func writeCache(path string, data interface{}) error {
-	err := doWriteCache(path, data)
+// storeProblems describes the problems in a store report.
+func storeProblems(report store.Report) []string {
+	problems := make([]string, 0)
+	if n := len(report.Corrupt); n > 0 {
+		offsets := make([]string, 0, n)
+		for _, offset := range report.Corrupt {
+			offsets = append(offsets, strconv.FormatInt(offset, 10))
+		}
+		problems = append(problems, fmt.Sprintf("store: %d corrupt records at offsets %s; their transactions are ignored",
+			n, strings.Join(offsets, ", ")))
+	}
+	if report.Truncated > 0 {
+		problems = append(problems, fmt.Sprintf("store: %d records from an interrupted write", report.Truncated))
+	}
+	if len(report.Duplicates) > 0 {
+		ids := make([]string, 0, len(report.Duplicates))
+		for _, id := range report.Duplicates {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		problems = append(problems, "store: duplicate activities "+strings.Join(ids, ", "))
+	}
+	if report.InvalidGear > 0 {
+		problems = append(problems, fmt.Sprintf("store: %d gear without an ID", report.InvalidGear))
+	}
+	if len(report.OrphanedGear) > 0 {
+		problems = append(problems, "store: activities use gear that isn't cached: "+strings.Join(report.OrphanedGear, ", "))
+	}
+	return problems
+}
+
+// damagedFiles reads every detail and stream file, returning those that
+// are truncated, corrupt or hold the wrong activity.
+func (s *sls) damagedFiles() ([]damagedFile, error) {
+	damaged := make([]damagedFile, 0)
+	err := eachCacheFile(s.detailCache, ".json", func(path string, id int64) {
+		var d strava.DetailedActivity
+		err := doReadCache(path, &d)
+		if err == nil && d.Id != id {
+			err = fmt.Errorf("holds activity %d", d.Id)
+		}
+		if err != nil && !errors.Is(err, errCacheVersion) {
+			damaged = append(damaged, damagedFile{path, err})
+		}
+	})
 	if err != nil {
-		log.Printf("Couldn't write cache to %s: %s", path, err)
+		return nil, err
 	}
-	return err
+	err = eachCacheFile(s.streams.dir, ".json.gz", func(path string, id int64) {
+		_, err := s.streams.read(id)
+		if err != nil {
+			damaged = append(damaged, damagedFile{path, err})
+		}
+	})
+	return damaged, err
+}
+
+// eachCacheFile calls fn for each file in dir named by an activity ID and
+// suffix.
+func eachCacheFile(dir, suffix string, fn func(path string, id int64)) error {
+	if dir == "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), suffix), 10, 64)
+		if e.IsDir() || !strings.HasSuffix(e.Name(), suffix) || err != nil {
+			continue
+		}
+		fn(filepath.Join(dir, e.Name()), id)
+	}
+	return nil
+}
+
+func (s *sls) cacheStats() error {
+	report, err := s.store.Check()
+	if err != nil {
+		return err
+	}
+	live := report.Activities + report.Gear + report.Locations
+	fmt.Printf("Store       %s, version %d\n", formatBytes(report.Size), report.Version)
+	fmt.Printf("Activities  %d", report.Activities)
+	if report.Activities > 0 {
+		fmt.Printf(" (%s to %s)", report.First.Format("2006-01-02"), report.Last.Format("2006-01-02"))
+	}
+	fmt.Println()
+	fmt.Printf("Gear        %d\n", report.Gear)
+	fmt.Printf("Locations   %d\n", report.Locations)
+	fmt.Printf("Log         %d records in %d transactions, %d live\n", report.Records, report.Transactions, live)
+
+	for _, c := range []struct {
+		name, dir, suffix string
+	}{
+		{"Details", s.detailCache, ".json"},
+		{"Streams", s.streams.dir, ".json.gz"},
+	} {
+		n, size := 0, int64(0)
+		err = eachCacheFile(c.dir, c.suffix, func(path string, id int64) {
+			if st, err := os.Stat(path); err == nil {
+				n++
+				size += st.Size()
+			}
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-10s  %d activities, %s\n", c.name, n, formatBytes(size))
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
 }
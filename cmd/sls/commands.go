@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/pflag"
+)
+
+type command struct {
+	name    string
+	summary string
+	flags   *pflag.FlagSet
+	// offline is set for commands that can run on cached data alone.
+	offline bool
+	// standalone is set for commands that work without config.toml and
+	// don't use the store or APIs. They're run with a nil *sls.
+	standalone bool
+	// verbs are the words the first argument can be, for shell completion.
+	verbs []string
+	run   func(ctx context.Context, s *sls, args []string) error
+}
+
+// Subcommands. Running sls without one lists activities.
+func subcommands() map[string]*command {
+	commands := make(map[string]*command)
+	for _, cmd := range []*command{
+		applyRulesCommand(),
+		authCommand(),
+		cacheCommand(),
+		completionCommand(),
+		componentCommand(),
+		configCommand(),
+		editCommand(),
+		exportCommand(),
+		gearCommand(),
+		listCommand("ls"),
+		serveWebhookCommand(),
+		showCommand(),
+		statsCommand(),
+		streamsCommand(),
+		syncCommand(),
+		uploadCommand(),
+		webhookCommand(),
+	} {
+		commands[cmd.name] = cmd
+	}
+	return commands
+}
+
+// findCommand picks the command named by the first argument, falling back to
+// listing activities, and returns the remaining arguments.
+func findCommand(args []string) (*command, []string) {
+	commands := subcommands()
+	if len(args) > 0 {
+		if cmd, ok := commands[args[0]]; ok {
+			return cmd, args[1:]
+		}
+	}
+
+	cmd := listCommand("sls")
+	cmd.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: sls [flags]\n       sls <command> [flags]\n\nCommands:\n")
+		names := make([]string, 0, len(commands))
+		width := 0
+		for name := range commands {
+			names = append(names, name)
+			if len(name) > width {
+				width = len(name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-*s  %s\n", width, name, commands[name].summary)
+		}
+		fmt.Fprintf(os.Stderr, "\nFlags:\n%s", cmd.flags.FlagUsages())
+	}
+	return cmd, args
+}
+
+// addGlobalFlags adds the flags every command takes.
+func addGlobalFlags(fs *pflag.FlagSet) {
+	fs.BoolP("debug", "d", false, "debug logging")
+	fs.Bool("offline", false, "use only cached data (default offline from the config)")
+}
+
+func newFlagSet(name string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ExitOnError)
+	fs.SortFlags = false
+	return fs
+}
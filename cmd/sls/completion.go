@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+func completionCommand() *command {
+	return &command{
+		name:       "completion",
+		summary:    "print a shell completion script (completion bash|zsh|fish)",
+		flags:      newFlagSet("completion"),
+		offline:    true,
+		standalone: true,
+		verbs:      []string{"bash", "zsh", "fish"},
+		run:        completion,
+	}
+}
+
+func completion(ctx context.Context, s *sls, args []string) error {
+	usage := errors.New("usage: sls completion bash|zsh|fish")
+	if len(args) != 1 {
+		return usage
+	}
+	generate, ok := map[string]func(io.Writer, []*command, *command){
+		"bash": bashCompletion,
+		"zsh":  zshCompletion,
+		"fish": fishCompletion,
+	}[args[0]]
+	if !ok {
+		return usage
+	}
+	list, commands := completionCommands()
+	generate(os.Stdout, commands, list)
+	return nil
+}
+
+// completionCommands returns the command run by plain sls and the
+// subcommands sorted by name, each with the global flags added.
+func completionCommands() (*command, []*command) {
+	list := listCommand("sls")
+	addGlobalFlags(list.flags)
+	commands := make([]*command, 0)
+	for _, cmd := range subcommands() {
+		addGlobalFlags(cmd.flags)
+		commands = append(commands, cmd)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].name < commands[j].name })
+	return list, commands
+}
+
+func visibleFlags(fs *pflag.FlagSet) []*pflag.Flag {
+	flags := make([]*pflag.Flag, 0)
+	fs.VisitAll(func(f *pflag.Flag) {
+		if !f.Hidden {
+			flags = append(flags, f)
+		}
+	})
+	return flags
+}
+
+func commandFlagSets(commands []*command) []*pflag.FlagSet {
+	sets := make([]*pflag.FlagSet, 0, len(commands))
+	for _, cmd := range commands {
+		sets = append(sets, cmd.flags)
+	}
+	return sets
+}
+
+// takesValue reports whether a flag needs an argument.
+func takesValue(f *pflag.Flag) bool {
+	return f.NoOptDefVal == ""
+}
+
+// flagWords returns every spelling of each flag.
+func flagWords(fs *pflag.FlagSet) []string {
+	words := make([]string, 0)
+	for _, f := range visibleFlags(fs) {
+		words = append(words, "--"+f.Name)
+		if f.Shorthand != "" {
+			words = append(words, "-"+f.Shorthand)
+		}
+	}
+	return words
+}
+
+func bashCompletion(w io.Writer, commands []*command, list *command) {
+	names := make([]string, 0, len(commands))
+	valueFlags := make(map[string]bool)
+	for _, fs := range append([]*pflag.FlagSet{list.flags}, commandFlagSets(commands)...) {
+		for _, f := range visibleFlags(fs) {
+			if takesValue(f) {
+				valueFlags["--"+f.Name] = true
+				if f.Shorthand != "" {
+					valueFlags["-"+f.Shorthand] = true
+				}
+			}
+		}
+	}
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	values := make([]string, 0, len(valueFlags))
+	for flag := range valueFlags {
+		values = append(values, flag)
+	}
+	sort.Strings(values)
+
+	fmt.Fprintf(w, "# bash completion for sls; generated by sls completion bash\n\n")
+	fmt.Fprintf(w, "_sls() {\n")
+	fmt.Fprintf(w, "\tlocal cur=${COMP_WORDS[COMP_CWORD]} prev=${COMP_WORDS[COMP_CWORD-1]} words\n")
+	fmt.Fprintf(w, "\tcase $prev in\n\t%s)\n\t\treturn\n\t\t;;\n\tesac\n", strings.Join(values, "|"))
+	fmt.Fprintf(w, "\tif [[ $COMP_CWORD -eq 1 ]]; then\n")
+	fmt.Fprintf(w, "\t\twords=\"%s\"\n", strings.Join(append(names, flagWords(list.flags)...), " "))
+	fmt.Fprintf(w, "\telse\n\t\tcase ${COMP_WORDS[1]} in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t\t%s)\n", cmd.name)
+		fmt.Fprintf(w, "\t\t\twords=\"%s\"\n", strings.Join(flagWords(cmd.flags), " "))
+		if len(cmd.verbs) > 0 {
+			fmt.Fprintf(w, "\t\t\t[[ $COMP_CWORD -eq 2 ]] && words+=\" %s\"\n", strings.Join(cmd.verbs, " "))
+		}
+		fmt.Fprintf(w, "\t\t\t;;\n")
+	}
+	fmt.Fprintf(w, "\t\t*)\n\t\t\twords=\"%s\"\n\t\t\t;;\n", strings.Join(flagWords(list.flags), " "))
+	fmt.Fprintf(w, "\t\tesac\n\tfi\n")
+	fmt.Fprintf(w, "\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n")
+	fmt.Fprintf(w, "}\n\ncomplete -o default -F _sls sls\n")
+}
+
+// zshQuote escapes s for a single-quoted _arguments spec or _describe item.
+func zshQuote(s string) string {
+	return strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`).Replace(s)
+}
+
+func zshFlagSpecs(fs *pflag.FlagSet) []string {
+	specs := make([]string, 0)
+	for _, f := range visibleFlags(fs) {
+		long, short, value := "--"+f.Name, "-"+f.Shorthand, ""
+		if takesValue(f) {
+			long += "="
+			short += "+"
+			value = ":" + f.Name + ":_default"
+		}
+		desc := "'[" + zshQuote(f.Usage) + "]" + value + "'"
+		if f.Shorthand == "" {
+			specs = append(specs, "'"+long+"'"+desc)
+		} else {
+			specs = append(specs, fmt.Sprintf("'(-%s --%s)'{%s,%s}%s", f.Shorthand, f.Name, short, long, desc))
+		}
+	}
+	return specs
+}
+
+func zshCompletion(w io.Writer, commands []*command, list *command) {
+	fmt.Fprintf(w, "#compdef sls\n\n# zsh completion for sls; generated by sls completion zsh\n\n")
+	fmt.Fprintf(w, "_sls() {\n\tlocal -a commands\n\tcommands=(\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t\t'%s:%s'\n", cmd.name, zshQuote(cmd.summary))
+	}
+	fmt.Fprintf(w, "\t)\n")
+	fmt.Fprintf(w, "\tif (( CURRENT == 2 )) && [[ $PREFIX != -* ]]; then\n")
+	fmt.Fprintf(w, "\t\t_describe -t commands 'sls command' commands\n\t\treturn\n\tfi\n")
+	fmt.Fprintf(w, "\tlocal cmd\n\t(( CURRENT > 2 )) && cmd=$words[2]\n")
+	fmt.Fprintf(w, "\tcase $cmd in\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "\t%s)\n\t\tshift words\n\t\t(( CURRENT-- ))\n\t\t_arguments -s", cmd.name)
+		for _, spec := range zshFlagSpecs(cmd.flags) {
+			fmt.Fprintf(w, " \\\n\t\t\t%s", spec)
+		}
+		if len(cmd.verbs) > 0 {
+			fmt.Fprintf(w, " \\\n\t\t\t'1:%s:(%s)'", cmd.name, strings.Join(cmd.verbs, " "))
+		}
+		fmt.Fprintf(w, " \\\n\t\t\t'*:file:_files'\n\t\t;;\n")
+	}
+	fmt.Fprintf(w, "\t*)\n\t\t_arguments -s")
+	for _, spec := range zshFlagSpecs(list.flags) {
+		fmt.Fprintf(w, " \\\n\t\t\t%s", spec)
+	}
+	fmt.Fprintf(w, "\n\t\t;;\n\tesac\n}\n\n_sls \"$@\"\n")
+}
+
+// fishQuote single-quotes s for fish.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+func fishFlags(w io.Writer, condition string, fs *pflag.FlagSet) {
+	for _, f := range visibleFlags(fs) {
+		fmt.Fprintf(w, "complete -c sls -n %s", fishQuote(condition))
+		if f.Shorthand != "" {
+			fmt.Fprintf(w, " -s %s", f.Shorthand)
+		}
+		fmt.Fprintf(w, " -l %s", f.Name)
+		if takesValue(f) {
+			fmt.Fprintf(w, " -r")
+		}
+		fmt.Fprintf(w, " -d %s\n", fishQuote(f.Usage))
+	}
+}
+
+func fishCompletion(w io.Writer, commands []*command, list *command) {
+	fmt.Fprintf(w, "# fish completion for sls; generated by sls completion fish\n\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "complete -c sls -n __fish_use_subcommand -f -a %s -d %s\n", cmd.name, fishQuote(cmd.summary))
+	}
+	fishFlags(w, "__fish_use_subcommand", list.flags)
+	for _, cmd := range commands {
+		condition := "__fish_seen_subcommand_from " + cmd.name
+		fmt.Fprintln(w)
+		if len(cmd.verbs) > 0 {
+			fmt.Fprintf(w, "complete -c sls -n %s -f -a %s\n",
+				fishQuote(condition+"; and not __fish_seen_subcommand_from "+strings.Join(cmd.verbs, " ")),
+				fishQuote(strings.Join(cmd.verbs, " ")))
+		}
+		fishFlags(w, condition, cmd.flags)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+// component is a part of some gear, such as a chain or tyre, whose wear is
+// tracked. It accumulates the distance of the gear's activities from the
+// time it was fitted until it's retired.
+type component struct {
+	Id     int       `json:"id"`
+	Kind   string    `json:"kind"`
+	Name   string    `json:"name,omitempty"`
+	GearId string    `json:"gear_id"`
+	From   time.Time `json:"from"`
+	// Retired is the start of the last activity the component counts.
+	Retired *time.Time `json:"retired,omitempty"`
+	// Limit is the distance in metres at which to replace it, overriding
+	// component_limits in the config.
+	Limit float64 `json:"limit,omitempty"`
+}
+
+// componentUsage is a component with totals from the cached activities.
+type componentUsage struct {
+	component
+	Count           int     `json:"count"`
+	Distance        float64 `json:"distance"`
+	IndoorDistance  float64 `json:"indoor_distance"`
+	OutdoorDistance float64 `json:"outdoor_distance"`
+	MovingTime      int     `json:"moving_time"`
+	ReplaceAt       float64 `json:"replace_at,omitempty"`
+}
+
+func (c *component) counts(a strava.Activity) bool {
+	return a.GearId == c.GearId && !a.StartDate.Before(c.From) &&
+		(c.Retired == nil || !a.StartDate.After(*c.Retired))
+}
+
+// limit returns the distance at which the component should be replaced, or
+// 0 if there isn't one.
+func (c *component) limit() (float64, error) {
+	if c.Limit > 0 {
+		return c.Limit, nil
+	}
+	limit := viper.GetStringMapString("component_limits")[c.Kind]
+	if limit == "" {
+		return 0, nil
+	}
+	metres, err := parseDistance(limit)
+	if err != nil {
+		return 0, fmt.Errorf("component_limits.%s: %w", c.Kind, err)
+	}
+	return metres, nil
+}
+
+// isIndoor reports whether an activity was done on a trainer. Strava's
+// trainer flag isn't always set, so the type and the app that recorded it
+// are checked too.
+func isIndoor(a strava.Activity) bool {
+	if a.Trainer || a.Type == "VirtualRide" {
+		return true
+	}
+	id := strings.ToLower(a.ExternalId)
+	return strings.HasPrefix(id, "trainerroad") || strings.HasPrefix(id, "zwift")
+}
+
+func componentCommand() *command {
+	fs := newFlagSet("component")
+	fs.String("gear", "", "gear the component is fitted to (name or ID)")
+	fs.Int64("from", 0, "first activity with the component (default from now on)")
+	fs.String("name", "", "a name for the component, e.g. its model")
+	fs.String("limit", "", "distance at which to replace it, e.g. 3000km (default from component_limits in the config)")
+	fs.Int64("to", 0, "last activity with the component (default the latest)")
+	fs.BoolP("all", "a", false, "include retired components")
+	fs.BoolP("json", "j", false, "JSON output")
+	return &command{
+		name:    "component",
+		summary: "track wear of chains, tyres and other components (component add|ls|retire)",
+		flags:   fs,
+		offline: true,
+		verbs:   []string{"add", "ls", "retire"},
+		run:     components,
+	}
+}
+
+func components(ctx context.Context, s *sls, args []string) error {
+	usage := errors.New("usage: sls component add <kind> --gear GEAR [--from ACTIVITY] [--name NAME] [--limit DIST]\n" +
+		"       sls component ls [--all]\n" +
+		"       sls component retire <component ID> [--to ACTIVITY]")
+	if len(args) == 0 {
+		return usage
+	}
+	switch {
+	case args[0] == "add" && len(args) == 2:
+		return s.addComponent(ctx, strings.ToLower(args[1]))
+	case args[0] == "ls" && len(args) == 1:
+		return s.listComponents(ctx)
+	case args[0] == "retire" && len(args) == 2:
+		id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid component ID %q", args[1])
+		}
+		return s.retireComponent(id)
+	}
+	return usage
+}
+
+func readComponents() ([]component, error) {
+	path := viper.GetString("components_file")
+	var components []component
+	err := doReadCache(path, &components)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read components from %s: %w", path, err)
+	}
+	return components, nil
+}
+
+func writeComponents(components []component) error {
+	path := viper.GetString("components_file")
+	err := doWriteCache(path, components)
+	if err != nil {
+		return fmt.Errorf("couldn't write components to %s: %w", path, err)
+	}
+	return nil
+}
+
+// cachedStart returns the start time of a cached activity.
+func (s *sls) cachedStart(id int64) (time.Time, error) {
+	a, ok, err := s.store.Activity(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !ok {
+		return time.Time{}, fmt.Errorf("activity %d isn't cached; run sls sync", id)
+	}
+	return a.StartDate, nil
+}
+
+// findGear is like resolveGear, but if the gear isn't cached it looks
+// through all the athlete's gear, which includes gear no cached activity
+// uses yet, such as a new bike.
+func (s *sls) findGear(ctx context.Context, nameOrId string) (string, error) {
+	gm := s.readGearCache()
+	gearId, err := resolveGear(gm, nameOrId)
+	if err == nil || s.offline {
+		return gearId, err
+	}
+	gears, fetchErr := s.sc.AthleteGear(ctx)
+	if fetchErr != nil {
+		return "", fmt.Errorf("%s; couldn't look for it on Strava: %w", err, fetchErr)
+	}
+	// Cache the summaries of new gear only; cached gear has more details.
+	new := make([]strava.Gear, 0)
+	for _, g := range gears {
+		if _, ok := gm[g.Id]; !ok {
+			gm[g.Id] = g
+			new = append(new, g)
+		}
+	}
+	err = s.store.PutGear(new...)
+	if err != nil {
+		return "", fmt.Errorf("couldn't store gear: %w", err)
+	}
+	return resolveGear(gm, nameOrId)
+}
+
+func (s *sls) addComponent(ctx context.Context, kind string) error {
+	if viper.GetString("gear") == "" {
+		return errors.New("give the gear the component is fitted to with --gear")
+	}
+	gearId, err := s.findGear(ctx, viper.GetString("gear"))
+	if err != nil {
+		return err
+	}
+	if gearId == strava.NoGear {
+		return errors.New("a component has to be fitted to some gear")
+	}
+
+	c := component{Kind: kind, Name: viper.GetString("name"), GearId: gearId, From: time.Now()}
+	if from := viper.GetInt64("from"); from != 0 {
+		c.From, err = s.cachedStart(from)
+		if err != nil {
+			return err
+		}
+	}
+	if limit := viper.GetString("limit"); limit != "" {
+		c.Limit, err = parseDistance(limit)
+		if err != nil {
+			return fmt.Errorf("invalid --limit: %w", err)
+		}
+	}
+
+	components, err := readComponents()
+	if err != nil {
+		return err
+	}
+	for _, other := range components {
+		if other.Id >= c.Id {
+			c.Id = other.Id + 1
+		}
+	}
+	if c.Id == 0 {
+		c.Id = 1
+	}
+	err = writeComponents(append(components, c))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %s %d\n", c.Kind, c.Id)
+	return nil
+}
+
+func (s *sls) retireComponent(id int) error {
+	components, err := readComponents()
+	if err != nil {
+		return err
+	}
+	for i := range components {
+		c := &components[i]
+		if c.Id != id {
+			continue
+		}
+		if c.Retired != nil {
+			return fmt.Errorf("component %d is already retired", id)
+		}
+		retired := time.Now()
+		if to := viper.GetInt64("to"); to != 0 {
+			retired, err = s.cachedStart(to)
+			if err != nil {
+				return err
+			}
+			if retired.Before(c.From) {
+				return fmt.Errorf("activity %d is from before component %d was fitted", to, id)
+			}
+		}
+		c.Retired = &retired
+		err = writeComponents(components)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Retired %s %d\n", c.Kind, c.Id)
+		return nil
+	}
+	return fmt.Errorf("no component %d", id)
+}
+
+// componentUsages totals the activities of each component.
+func componentUsages(components []component, activities strava.Activities) ([]componentUsage, error) {
+	usages := make([]componentUsage, 0, len(components))
+	for _, c := range components {
+		limit, err := c.limit()
+		if err != nil {
+			return nil, err
+		}
+		u := componentUsage{component: c, ReplaceAt: limit}
+		for _, a := range activities {
+			if !c.counts(a) {
+				continue
+			}
+			u.Count++
+			u.Distance += a.Distance
+			u.MovingTime += a.MovingTime
+			if isIndoor(a) {
+				u.IndoorDistance += a.Distance
+			} else {
+				u.OutdoorDistance += a.Distance
+			}
+		}
+		usages = append(usages, u)
+	}
+	return usages, nil
+}
+
+func (u *componentUsage) wornOut() bool {
+	return u.Retired == nil && u.ReplaceAt > 0 && u.Distance >= u.ReplaceAt
+}
+
+func (u *componentUsage) describe(gears GearMap) string {
+	s := fmt.Sprintf("%s %d", u.Kind, u.Id)
+	if u.Name != "" {
+		s += fmt.Sprintf(" (%s)", u.Name)
+	}
+	return s + " on " + gearName(gears, u.GearId)
+}
+
+// warnWornComponents warns about components that have reached their limit.
+func warnWornComponents(activities strava.Activities, gears GearMap) error {
+	components, err := readComponents()
+	if err != nil {
+		return err
+	}
+	usages, err := componentUsages(components, activities)
+	if err != nil {
+		return err
+	}
+	warnWorn(usages, gears)
+	return nil
+}
+
+func warnWorn(usages []componentUsage, gears GearMap) {
+	for _, u := range usages {
+		if u.wornOut() {
+			log.Warnf("%s has done %.0f km; replace it at %.0f km", u.describe(gears), u.Distance/1000, u.ReplaceAt/1000)
+		}
+	}
+}
+
+func (s *sls) listComponents(ctx context.Context) error {
+	components, err := readComponents()
+	if err != nil {
+		return err
+	}
+	activities, err := s.activities(ctx)
+	if err != nil && !degrade(err, "activities") {
+		return err
+	}
+	gears, err := s.gears(ctx, activities)
+	if err != nil && !degrade(err, "gear") {
+		return err
+	}
+
+	usages, err := componentUsages(components, activities)
+	if err != nil {
+		return err
+	}
+	shown := make([]componentUsage, 0, len(usages))
+	for _, u := range usages {
+		if u.Retired == nil || viper.GetBool("all") {
+			shown = append(shown, u)
+		}
+	}
+	sort.SliceStable(shown, func(i, j int) bool {
+		return gearName(gears, shown[i].GearId) < gearName(gears, shown[j].GearId)
+	})
+
+	if viper.GetBool("json") {
+		j, err := json.Marshal(shown)
+		if err != nil {
+			return fmt.Errorf("couldn't marshal to JSON: %w", err)
+		}
+		fmt.Print(string(j))
+		return nil
+	}
+
+	rows := [][]string{{"ID", "Gear", "Kind", "Fitted", "Retired", "Count", "Dist", "Indoor", "Outdoor", "Limit", "Name"}}
+	for _, u := range shown {
+		retired, limit := "-", "-"
+		if u.Retired != nil {
+			retired = u.Retired.Local().Format("2006-01-02")
+		}
+		if u.ReplaceAt > 0 {
+			limit = fmt.Sprintf("%.0f", u.ReplaceAt/1000)
+			if u.wornOut() {
+				limit += " !"
+			}
+		}
+		name := u.Name
+		if name == "" {
+			name = "-"
+		}
+		rows = append(rows, []string{
+			strconv.Itoa(u.Id),
+			gearName(gears, u.GearId),
+			u.Kind,
+			u.From.Local().Format("2006-01-02"),
+			retired,
+			strconv.Itoa(u.Count),
+			fmt.Sprintf("%.1f", u.Distance/1000),
+			fmt.Sprintf("%.1f", u.IndoorDistance/1000),
+			fmt.Sprintf("%.1f", u.OutdoorDistance/1000),
+			limit,
+			name,
+		})
+	}
+	aligns := []alignment{alignRight, alignLeft, alignLeft, alignRight, alignRight, alignRight,
+		alignRight, alignRight, alignRight, alignRight, alignLeft}
+	for _, line := range formatTable(rows, aligns) {
+		fmt.Println(line)
+	}
+	warnWorn(shown, gears)
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/spf13/viper"
+)
+
+// Settings whose values sls config masks.
+var secretSettings = map[string]bool{
+	"client_secret":        true,
+	"google_maps_api_key":  true,
+	"webhook_verify_token": true,
+}
+
+func configCommand() *command {
+	return &command{
+		name:       "config",
+		summary:    "show settings (config [get <key>|path])",
+		flags:      newFlagSet("config"),
+		offline:    true,
+		standalone: true,
+		verbs:      []string{"get", "path"},
+		run:        config,
+	}
+}
+
+func config(ctx context.Context, s *sls, args []string) error {
+	usage := errors.New("usage: sls config [get <key>|path]")
+	if len(args) == 0 {
+		return showConfig()
+	}
+	switch args[0] {
+	case "get":
+		if len(args) != 2 {
+			return usage
+		}
+		if !viper.IsSet(args[1]) {
+			return fmt.Errorf("%s isn't set", args[1])
+		}
+		fmt.Println(viper.Get(args[1]))
+		return nil
+	case "path":
+		if len(args) != 1 {
+			return usage
+		}
+		fmt.Println(viper.ConfigFileUsed())
+		return nil
+	}
+	return usage
+}
+
+// showConfig prints every setting, including defaults, masking secrets.
+func showConfig() error {
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := fmt.Sprint(viper.Get(key))
+		if secretSettings[key] && value != "" {
+			value = "********"
+		}
+		fmt.Printf("%s = %s\n", key, value)
+	}
+	return nil
+}
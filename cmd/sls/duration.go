@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"us": time.Microsecond,
+	"µs": time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  day,
+	"w":  7 * day,
+	"y":  365 * day,
+}
+
+// parseDuration extends time.ParseDuration with day ("90d"), week ("12w")
+// and year ("1y", 365 days) units, which combine with the others like
+// "1d12h". Negative durations aren't allowed.
+func parseDuration(s string) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid duration %q", s)
+	if s == "0" {
+		return 0, nil
+	}
+	if s == "" {
+		return 0, invalid
+	}
+	var d time.Duration
+	for s != "" {
+		i := 0
+		for i < len(s) && (s[i] == '.' || s[i] >= '0' && s[i] <= '9') {
+			i++
+		}
+		j := i
+		for j < len(s) && s[j] != '.' && (s[j] < '0' || s[j] > '9') {
+			j++
+		}
+		n, err := strconv.ParseFloat(s[:i], 64)
+		unit, ok := durationUnits[s[i:j]]
+		if err != nil || !ok {
+			return 0, invalid
+		}
+		d += time.Duration(n * float64(unit))
+		s = s[j:]
+	}
+	return d, nil
+}
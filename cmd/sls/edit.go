@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Strava gear IDs are "b" (bikes) or "g" (shoes) followed by a number.
+var reGearId = regexp.MustCompile(`^[bg]\d+$`)
+
+// activityEdit is a planned update to one activity. changes describes each
+// field that will change.
+type activityEdit struct {
+	a       strava.Activity
+	update  strava.UpdatableActivity
+	changes []string
+}
+
+func editCommand() *command {
+	fs := newFlagSet("edit")
+	fs.String("set-name", "", "rename activities")
+	fs.String("set-type", "", "change the activity type, e.g. Ride")
+	fs.String("set-gear", "", `change gear (name or ID, or "none" to remove it)`)
+	fs.Bool("commute", false, "mark as a commute (--commute=false to unmark)")
+	fs.Bool("trainer", false, "mark as a trainer activity (--trainer=false to unmark)")
+	addFilterFlags(fs)
+	addReviewFlags(fs)
+	return &command{
+		name:    "edit",
+		summary: "rename, re-gear or retype activities, or mark commutes",
+		flags:   fs,
+		run:     edit,
+	}
+}
+
+func edit(ctx context.Context, s *sls, args []string) error {
+	f, err := newActivityFilter()
+	if err != nil {
+		return err
+	}
+	if (len(args) > 0) == !f.empty() {
+		return errors.New("usage: sls edit [flags] <activity ID>...\n" +
+			"       sls edit [flags] --type|--gear|--name|--where <filter>")
+	}
+
+	gears := s.readGearCache()
+	update, err := newUpdate(gears)
+	if err != nil {
+		return err
+	}
+	if update == (strava.UpdatableActivity{}) {
+		return errors.New("nothing to change; use --set-name, --set-type, --set-gear, --commute or --trainer")
+	}
+
+	var activities strava.Activities
+	if len(args) > 0 {
+		activities, err = s.activitiesById(ctx, args)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, ca := range f.filter(compose(s.readActivityCache(), gears, nil)) {
+			activities = append(activities, ca.A)
+		}
+	}
+
+	return s.reviewEdits(ctx, planEdits(activities, update, gears))
+}
+
+// reviewEdits prints planned edits and, unless --dry-run was given, applies
+// them once confirmed.
+func (s *sls) reviewEdits(ctx context.Context, edits []activityEdit) error {
+	for _, e := range edits {
+		fmt.Printf("%s  %d  %s: %s\n", formatStartDate(e.a), e.a.Id, e.a.Name, strings.Join(e.changes, ", "))
+	}
+	if len(edits) == 0 {
+		fmt.Println("Nothing to change")
+		return nil
+	}
+	if viper.GetBool("dry-run") {
+		fmt.Printf("Would update %d activities\n", len(edits))
+		return nil
+	}
+	if !viper.GetBool("yes") && !confirm(fmt.Sprintf("Update %d activities?", len(edits))) {
+		fmt.Println("Nothing changed")
+		return nil
+	}
+	return s.applyEdits(ctx, edits)
+}
+
+func addReviewFlags(fs *pflag.FlagSet) {
+	fs.BoolP("dry-run", "n", false, "show what would change without changing anything")
+	fs.BoolP("yes", "y", false, "don't ask for confirmation")
+}
+
+// newUpdate builds an update from the --set-* flags.
+func newUpdate(gears GearMap) (strava.UpdatableActivity, error) {
+	var update strava.UpdatableActivity
+	if viper.IsSet("set-name") {
+		name := viper.GetString("set-name")
+		update.Name = &name
+	}
+	if viper.IsSet("set-type") {
+		typ := viper.GetString("set-type")
+		update.Type = &typ
+	}
+	if viper.IsSet("set-gear") {
+		id, err := resolveGear(gears, viper.GetString("set-gear"))
+		if err != nil {
+			return update, err
+		}
+		update.GearId = &id
+	}
+	if viper.IsSet("commute") {
+		commute := viper.GetBool("commute")
+		update.Commute = &commute
+	}
+	if viper.IsSet("trainer") {
+		trainer := viper.GetBool("trainer")
+		update.Trainer = &trainer
+	}
+	return update, nil
+}
+
+// resolveGear turns a gear name or ID into an ID. Gear is looked up in the
+// gear cache, so only gear used by a cached activity can be given by name.
+func resolveGear(gears GearMap, nameOrId string) (string, error) {
+	if strings.EqualFold(nameOrId, strava.NoGear) {
+		return strava.NoGear, nil
+	}
+	if _, ok := gears[nameOrId]; ok {
+		return nameOrId, nil
+	}
+	ids := make([]string, 0)
+	for id, g := range gears {
+		if strings.EqualFold(g.Name, nameOrId) {
+			ids = append(ids, id)
+		}
+	}
+	switch {
+	case len(ids) == 1:
+		return ids[0], nil
+	case len(ids) > 1:
+		return "", fmt.Errorf("gear name %q is ambiguous; use one of IDs %s", nameOrId, strings.Join(ids, ", "))
+	case reGearId.MatchString(nameOrId):
+		return nameOrId, nil
+	}
+	return "", fmt.Errorf("unknown gear %q", nameOrId)
+}
+
+// planEdits works out which fields of each activity the update would change,
+// leaving out activities it wouldn't change at all.
+func planEdits(activities strava.Activities, update strava.UpdatableActivity, gears GearMap) []activityEdit {
+	edits := make([]activityEdit, 0, len(activities))
+	for _, a := range activities {
+		e := activityEdit{a: a}
+		if update.Name != nil && *update.Name != a.Name {
+			e.update.Name = update.Name
+			e.changes = append(e.changes, fmt.Sprintf("name %q -> %q", a.Name, *update.Name))
+		}
+		if update.Type != nil && *update.Type != a.Type {
+			e.update.Type = update.Type
+			e.changes = append(e.changes, fmt.Sprintf("type %s -> %s", a.Type, *update.Type))
+		}
+		if update.GearId != nil {
+			gearId := *update.GearId
+			if gearId == strava.NoGear {
+				gearId = ""
+			}
+			if gearId != a.GearId {
+				e.update.GearId = update.GearId
+				e.changes = append(e.changes, fmt.Sprintf("gear %s -> %s", gearName(gears, a.GearId), gearName(gears, gearId)))
+			}
+		}
+		if update.Commute != nil && *update.Commute != a.Commute {
+			e.update.Commute = update.Commute
+			e.changes = append(e.changes, fmt.Sprintf("commute %t -> %t", a.Commute, *update.Commute))
+		}
+		if update.Trainer != nil && *update.Trainer != a.Trainer {
+			e.update.Trainer = update.Trainer
+			e.changes = append(e.changes, fmt.Sprintf("trainer %t -> %t", a.Trainer, *update.Trainer))
+		}
+		if len(e.changes) > 0 {
+			edits = append(edits, e)
+		}
+	}
+	return edits
+}
+
+// applyEdits pushes edits to Strava and stores the updated activities, so
+// that listings reflect them without a refresh. Activities that aren't
+// stored yet are left for the next fetch.
+func (s *sls) applyEdits(ctx context.Context, edits []activityEdit) error {
+	var err error
+	updated := 0
+	for _, e := range edits {
+		var d strava.DetailedActivity
+		d, err = s.sc.UpdateActivity(ctx, e.a.Id, e.update)
+		if errors.Is(err, strava.ErrUnauthorized) {
+			err = fmt.Errorf("%w (run sls auth to allow sls to edit activities)", err)
+		}
+		if err != nil {
+			err = fmt.Errorf("couldn't update activity %d: %w", e.a.Id, err)
+			break
+		}
+		updated++
+		s.writeDetailCache(d)
+		if _, ok, _ := s.store.Activity(d.Id); ok {
+			err = s.store.PutActivities(d.Summary())
+			if err != nil {
+				err = fmt.Errorf("couldn't store activity %d: %w", d.Id, err)
+				break
+			}
+		}
+	}
+
+	fmt.Printf("Updated %d of %d activities\n", updated, len(edits))
+	return err
+}
+
+// confirm asks a yes/no question on the terminal. Anything but yes is no.
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/markdrayton/sls/export"
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+var exportFormats = map[string]func(io.Writer, strava.Activity, strava.StreamSet) error{
+	"gpx": export.GPX,
+	"tcx": export.TCX,
+}
+
+func exportCommand() *command {
+	fs := newFlagSet("export")
+	fs.Bool("all", false, "export every cached activity (narrowed by the filter flags)")
+	fs.String("dir", ".", "directory to write files to")
+	addFilterFlags(fs)
+	return &command{
+		name:    "export",
+		summary: "export activities as GPX or TCX files",
+		flags:   fs,
+		offline: true,
+		verbs:   []string{"gpx", "tcx"},
+		run:     exportActivities,
+	}
+}
+
+func exportActivities(ctx context.Context, s *sls, args []string) error {
+	usage := errors.New("usage: sls export gpx|tcx [flags] <activity ID>...\n       sls export gpx|tcx --all [flags]")
+	if len(args) == 0 {
+		return usage
+	}
+	format := args[0]
+	if _, ok := exportFormats[format]; !ok {
+		return usage
+	}
+	all := viper.GetBool("all")
+	if all == (len(args) > 1) {
+		return usage
+	}
+
+	var activities strava.Activities
+	if all {
+		f, err := newActivityFilter()
+		if err != nil {
+			return err
+		}
+		cas := f.filter(compose(s.readActivityCache(), s.readGearCache(), nil))
+		for i := len(cas) - 1; i >= 0; i-- {
+			activities = append(activities, cas[i].A)
+		}
+	} else {
+		var err error
+		activities, err = s.activitiesById(ctx, args[1:])
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := viper.GetString("dir")
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	exported, skipped := 0, 0
+	for _, a := range activities {
+		path, err := s.exportActivity(ctx, a, format, dir)
+		if all && (errors.Is(err, export.ErrNoTime) || errors.Is(err, export.ErrNoPosition)) {
+			log.Infof("skipping activity %d: %s", a.Id, err)
+			skipped++
+			continue
+		}
+		if all && errors.Is(err, errNotCached) {
+			log.Debugf("skipping activity %d: %s", a.Id, err)
+			skipped++
+			continue
+		}
+		if all && errors.Is(err, strava.ErrRateLimited) {
+			log.Warnf("stopping: %s", err)
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't export activity %d: %w", a.Id, err)
+		}
+		exported++
+		fmt.Println(path)
+	}
+	if all {
+		fmt.Printf("Exported %d activities; skipped %d without usable streams\n", exported, skipped)
+	}
+	return nil
+}
+
+// activitiesById looks up activities in the cache, fetching any that aren't
+// cached.
+func (s *sls) activitiesById(ctx context.Context, args []string) (strava.Activities, error) {
+	cached := make(map[int64]strava.Activity)
+	for _, a := range s.readActivityCache() {
+		cached[a.Id] = a
+	}
+
+	activities := make(strava.Activities, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid activity ID %q", arg)
+		}
+		a, ok := cached[id]
+		if !ok {
+			d, err := s.detailedActivity(ctx, id)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't fetch activity %d: %w", id, err)
+			}
+			a = d.Activity
+		}
+		activities = append(activities, a)
+	}
+	return activities, nil
+}
+
+// exportActivity writes one activity to dir and returns the file's path.
+func (s *sls) exportActivity(ctx context.Context, a strava.Activity, format, dir string) (string, error) {
+	streams, err := s.activityStreams(ctx, a.Id)
+	if err != nil {
+		return "", err
+	}
+
+	var b bytes.Buffer
+	err = exportFormats[format](&b, a, streams)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, export.Filename(a, format))
+	return path, ioutil.WriteFile(path, b.Bytes(), 0644)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// activityFilter selects activities for commands that act on a subset of
+// them.
+type activityFilter struct {
+	types []string
+	gear  string
+	name  *regexp.Regexp
+	where whereExpr
+	// Local start dates, inclusive, as midnight UTC.
+	since, until time.Time
+	after        time.Time // --last
+}
+
+func addFilterFlags(fs *pflag.FlagSet) {
+	fs.StringSlice("type", nil, "only activities of these types, e.g. Ride,VirtualRide")
+	fs.String("gear", "", "only activities with this gear (name or ID)")
+	fs.String("name", "", "only activities whose name matches this regular expression")
+	fs.String("where", "", "only activities matching this expression, e.g. 'type = Ride && dist > 100km'")
+	fs.String("since", "", "only activities on or after this date (YYYY-MM-DD)")
+	fs.String("until", "", "only activities on or before this date (YYYY-MM-DD)")
+	fs.String("last", "", "only activities in this period up to now, e.g. 30d, 12w or 1y6w")
+	fs.Int("year", 0, "only activities in this year")
+}
+
+func newActivityFilter() (*activityFilter, error) {
+	f := &activityFilter{
+		types: viper.GetStringSlice("type"),
+		gear:  viper.GetString("gear"),
+	}
+	if name := viper.GetString("name"); name != "" {
+		re, err := regexp.Compile(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --name pattern: %w", err)
+		}
+		f.name = re
+	}
+	if where := viper.GetString("where"); where != "" {
+		e, err := parseWhere(where)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --where expression: %w", err)
+		}
+		f.where = e
+	}
+
+	for _, flag := range []struct {
+		name string
+		date *time.Time
+	}{{"since", &f.since}, {"until", &f.until}} {
+		if value := viper.GetString(flag.name); value != "" {
+			date, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --%s date %q; use YYYY-MM-DD", flag.name, value)
+			}
+			*flag.date = date
+		}
+	}
+	if year := viper.GetInt("year"); year != 0 {
+		start := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		end := time.Date(year, 12, 31, 0, 0, 0, 0, time.UTC)
+		if start.After(f.since) {
+			f.since = start
+		}
+		if f.until.IsZero() || end.Before(f.until) {
+			f.until = end
+		}
+	}
+	if last := viper.GetString("last"); last != "" {
+		d, err := parseDuration(last)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --last: %w", err)
+		}
+		f.after = time.Now().Add(-d)
+	}
+	return f, nil
+}
+
+// empty reports whether the filter matches every activity.
+func (f *activityFilter) empty() bool {
+	return len(f.types) == 0 && f.gear == "" && f.name == nil && f.where == nil &&
+		f.since.IsZero() && f.until.IsZero() && f.after.IsZero()
+}
+
+// matchActivity checks the criteria that need only the activity itself, so
+// that activities can be selected before gear and locations are looked up.
+func (f *activityFilter) matchActivity(a strava.Activity) bool {
+	if len(f.types) > 0 && !containsFold(f.types, a.Type) {
+		return false
+	}
+	if f.name != nil && !f.name.MatchString(a.Name) {
+		return false
+	}
+	if !f.since.IsZero() || !f.until.IsZero() {
+		day, ok := startDay(a)
+		if !ok || day.Before(f.since) || (!f.until.IsZero() && day.After(f.until)) {
+			return false
+		}
+	}
+	if !f.after.IsZero() && a.StartDate.Before(f.after) {
+		return false
+	}
+	return true
+}
+
+func (f *activityFilter) match(ca CompositeActivity) bool {
+	if !f.matchActivity(ca.A) {
+		return false
+	}
+	if f.gear != "" && !strings.EqualFold(f.gear, ca.G.Name) && f.gear != ca.A.GearId {
+		return false
+	}
+	if f.where != nil && !f.where.eval(ca) {
+		return false
+	}
+	return true
+}
+
+// selectActivities returns the activities matchActivity accepts.
+func (f *activityFilter) selectActivities(activities strava.Activities) strava.Activities {
+	selected := make(strava.Activities, 0, len(activities))
+	for _, a := range activities {
+		if f.matchActivity(a) {
+			selected = append(selected, a)
+		}
+	}
+	return selected
+}
+
+func (f *activityFilter) filter(cas []CompositeActivity) []CompositeActivity {
+	matched := make([]CompositeActivity, 0, len(cas))
+	for _, ca := range cas {
+		if f.match(ca) {
+			matched = append(matched, ca)
+		}
+	}
+	return matched
+}
+
+// startDay returns the local date an activity started on, as midnight UTC
+// so that dates compare the same whatever zone they were in.
+func startDay(a strava.Activity) (time.Time, bool) {
+	t, err := a.StartTimeLocal()
+	if err != nil {
+		return time.Time{}, false
+	}
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC), true
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,8 @@ import (
 	"strconv"
 	"strings"
 	"unicode/utf8"
+
+	"github.com/markdrayton/sls/strava"
 )
 
 type alignment int
@@ -113,7 +115,16 @@ func (af *ActivityFormatter) Format(activities []CompositeActivity) []string {
 }
 
 func formatDate(af *ActivityFormatter, ca CompositeActivity) string {
-	return ca.A.StartDateLocal[:10]
+	return formatStartDate(ca.A)
+}
+
+// formatStartDate returns the local date an activity started on.
+func formatStartDate(a strava.Activity) string {
+	day, ok := startDay(a)
+	if !ok {
+		return "?"
+	}
+	return day.Format("2006-01-02")
 }
 
 func formatId(af *ActivityFormatter, ca CompositeActivity) string {
@@ -157,7 +168,10 @@ func formatAveragePower(af *ActivityFormatter, ca CompositeActivity) string {
 }
 
 func formatTime(af *ActivityFormatter, ca CompositeActivity) string {
-	t := ca.A.MovingTime
+	return formatSeconds(ca.A.MovingTime)
+}
+
+func formatSeconds(t int) string {
 	h := t / 3600
 	t = t - (h * 3600)
 	m := t / 60
@@ -227,3 +241,30 @@ func formatGear(af *ActivityFormatter, ca CompositeActivity) string {
 func formatName(af *ActivityFormatter, ca CompositeActivity) string {
 	return ca.A.Name
 }
+
+// formatTable lays out rows of cells in aligned columns. The first row is
+// the header.
+func formatTable(rows [][]string, aligns []alignment) []string {
+	widths := make([]int, len(aligns))
+	for _, row := range rows {
+		for i, cell := range row {
+			if width := utf8.RuneCountInString(cell); width > widths[i] {
+				widths[i] = width
+			}
+		}
+	}
+
+	output := make([]string, 0, len(rows))
+	for _, row := range rows {
+		vals := make([]string, 0, len(row))
+		for i, cell := range row {
+			pattern := "%*s"
+			if aligns[i] == alignLeft {
+				pattern = "%-*s"
+			}
+			vals = append(vals, fmt.Sprintf(pattern, widths[i], cell))
+		}
+		output = append(output, strings.TrimRight(strings.Join(vals, "  "), " "))
+	}
+	return output
+}
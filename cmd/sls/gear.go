@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+// gearUsage is a gear with totals computed from the cached activities.
+// Distance can differ from G.Distance, Strava's total, which also counts
+// activities that aren't cached and distance entered by hand.
+type gearUsage struct {
+	G          strava.Gear `json:"gear"`
+	Count      int         `json:"count"`
+	Distance   float64     `json:"distance"`
+	MovingTime int         `json:"moving_time"`
+	// Local start dates of the first and last activities.
+	FirstUsed string `json:"first_used,omitempty"`
+	LastUsed  string `json:"last_used,omitempty"`
+}
+
+func gearCommand() *command {
+	fs := newFlagSet("gear")
+	fs.Bool("retired", false, "only show retired gear")
+	fs.BoolP("all", "a", false, "show retired gear too")
+	fs.BoolP("json", "j", false, "JSON output")
+	fs.BoolP("refresh", "r", false, "refetch gear")
+	return &command{
+		name:    "gear",
+		summary: "list bikes and shoes and how much they've been used",
+		flags:   fs,
+		offline: true,
+		run:     gear,
+	}
+}
+
+func gear(ctx context.Context, s *sls, args []string) error {
+	activities, err := s.activities(ctx)
+	if err != nil && !degrade(err, "activities") {
+		return err
+	}
+	gears, err := s.athleteGears(ctx)
+	if err != nil && !degrade(err, "gear") {
+		return err
+	}
+
+	usage := make(map[string]*gearUsage, len(gears))
+	for id, g := range gears {
+		show := viper.GetBool("all") || g.Retired == viper.GetBool("retired")
+		if id != "" && show {
+			usage[id] = &gearUsage{G: g}
+		}
+	}
+	// Activities are sorted by start time.
+	for _, a := range activities {
+		u, ok := usage[a.GearId]
+		if !ok {
+			continue
+		}
+		if u.Count == 0 {
+			u.FirstUsed = formatStartDate(a)
+		}
+		u.LastUsed = formatStartDate(a)
+		u.Count++
+		u.Distance += a.Distance
+		u.MovingTime += a.MovingTime
+	}
+	gu := make([]gearUsage, 0, len(usage))
+	for _, u := range usage {
+		gu = append(gu, *u)
+	}
+	sort.Slice(gu, func(i, j int) bool {
+		if gu[i].G.IsBike() != gu[j].G.IsBike() {
+			return gu[i].G.IsBike()
+		}
+		return strings.ToLower(gu[i].G.Name) < strings.ToLower(gu[j].G.Name)
+	})
+
+	if viper.GetBool("json") {
+		j, err := json.Marshal(gu)
+		if err != nil {
+			return fmt.Errorf("couldn't marshal to JSON: %w", err)
+		}
+		fmt.Print(string(j))
+		return nil
+	}
+
+	rows := [][]string{{"ID", "Kind", "Count", "Dist", "Strava", "Time", "First", "Last", "Name", "Model"}}
+	for _, u := range gu {
+		name := u.G.Name
+		if u.G.Primary {
+			name += " *"
+		}
+		if u.G.Retired {
+			name += " (retired)"
+		}
+		kind := "shoes"
+		if u.G.IsBike() {
+			kind = "bike"
+		}
+		model := strings.TrimSpace(u.G.BrandName + " " + u.G.ModelName)
+		rows = append(rows, []string{
+			u.G.Id,
+			kind,
+			strconv.Itoa(u.Count),
+			fmt.Sprintf("%.1f", u.Distance/1000),
+			fmt.Sprintf("%.1f", u.G.Distance/1000),
+			formatSeconds(u.MovingTime),
+			dashIfEmpty(u.FirstUsed),
+			dashIfEmpty(u.LastUsed),
+			name,
+			dashIfEmpty(model),
+		})
+	}
+	aligns := []alignment{alignLeft, alignLeft, alignRight, alignRight, alignRight, alignRight, alignRight, alignRight, alignLeft, alignLeft}
+	for _, line := range formatTable(rows, aligns) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
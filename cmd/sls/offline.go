@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// errOffline is returned for requests attempted in offline mode.
+	errOffline = errors.New("offline")
+	// errNotCached is returned in offline mode for data that would have to
+	// be fetched.
+	errNotCached = errors.New("not cached (offline)")
+)
+
+// offlineTransport fails every request, so that nothing slips onto the
+// network in offline mode.
+type offlineTransport struct{}
+
+func (offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("%s %s: %w", req.Method, req.URL.Host, errOffline)
+}
+
+// degrade reports whether a failure to update cached data can be worked
+// around by showing what's cached, warning if so. Only an interrupt can't.
+func degrade(err error, what string) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	log.Warnf("couldn't update %s, showing cached data: %s", what, err)
+	return true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/markdrayton/sls/geo"
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+const defaultStartWithinKm = 1
+
+// gearRule assigns gear to activities matching all of its conditions. A
+// condition with several values matches any of them.
+type gearRule struct {
+	Gear             string    `mapstructure:"gear"`
+	Type             []string  `mapstructure:"type"`
+	Name             string    `mapstructure:"name"`
+	ExternalIdPrefix []string  `mapstructure:"external_id_prefix"`
+	StartNear        []float64 `mapstructure:"start_near"`
+	StartWithinKm    float64   `mapstructure:"start_within_km"`
+
+	gearId string
+	name   *regexp.Regexp
+}
+
+func applyRulesCommand() *command {
+	fs := newFlagSet("apply-rules")
+	addFilterFlags(fs)
+	addReviewFlags(fs)
+	return &command{
+		name:    "apply-rules",
+		summary: "assign gear to activities using the rules file",
+		flags:   fs,
+		run:     applyRules,
+	}
+}
+
+func applyRules(ctx context.Context, s *sls, args []string) error {
+	f, err := newActivityFilter()
+	if err != nil {
+		return err
+	}
+	gears := s.readGearCache()
+	rules, err := readRules(viper.GetString("rules_file"), gears)
+	if err != nil {
+		return err
+	}
+
+	edits := make([]activityEdit, 0)
+	for _, ca := range f.filter(compose(s.readActivityCache(), gears, nil)) {
+		for i, r := range rules {
+			if !r.match(ca.A) {
+				continue
+			}
+			update := strava.UpdatableActivity{GearId: &rules[i].gearId}
+			for _, e := range planEdits(strava.Activities{ca.A}, update, gears) {
+				e.changes[0] += fmt.Sprintf(" (rule %d)", i+1)
+				edits = append(edits, e)
+			}
+			break // first matching rule wins
+		}
+	}
+	return s.reviewEdits(ctx, edits)
+}
+
+// readRules reads gear rules from a TOML file of [[rule]] tables and checks
+// them against the cached gear.
+func readRules(path string, gears GearMap) ([]gearRule, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("toml")
+	err := v.ReadInConfig()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("no rules file at %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read rules: %w", err)
+	}
+
+	var rules []gearRule
+	err = v.UnmarshalKey("rule", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read rules: %w", err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no [[rule]] tables in %s", path)
+	}
+	for i := range rules {
+		err := rules[i].compile(gears)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *gearRule) compile(gears GearMap) error {
+	if r.Gear == "" {
+		return errors.New("no gear")
+	}
+	id, err := resolveGear(gears, r.Gear)
+	if err != nil {
+		return err
+	}
+	r.gearId = id
+
+	if len(r.Type) == 0 && r.Name == "" && len(r.ExternalIdPrefix) == 0 && r.StartNear == nil {
+		return errors.New("no conditions")
+	}
+	if r.Name != "" {
+		r.name, err = regexp.Compile(r.Name)
+		if err != nil {
+			return fmt.Errorf("invalid name pattern: %w", err)
+		}
+	}
+	if r.StartNear != nil && len(r.StartNear) != 2 {
+		return errors.New("start_near must be [lat, lng]")
+	}
+	if r.StartWithinKm == 0 {
+		r.StartWithinKm = defaultStartWithinKm
+	}
+	return nil
+}
+
+func (r *gearRule) match(a strava.Activity) bool {
+	if len(r.Type) > 0 && !containsFold(r.Type, a.Type) {
+		return false
+	}
+	if r.name != nil && !r.name.MatchString(a.Name) {
+		return false
+	}
+	if len(r.ExternalIdPrefix) > 0 {
+		found := false
+		for _, prefix := range r.ExternalIdPrefix {
+			if strings.HasPrefix(strings.ToLower(a.ExternalId), strings.ToLower(prefix)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.StartNear != nil {
+		near := geo.LatLng{r.StartNear[0], r.StartNear[1]}
+		if a.StartLatLng.IsZero() || geo.Distance(near, a.StartLatLng) > r.StartWithinKm {
+			return false
+		}
+	}
+	return true
+}
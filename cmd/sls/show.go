@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+// DetailedCompositeActivity is a CompositeActivity whose activity has been
+// fetched in full. D shadows A when marshalled, so the JSON has the same
+// shape as a CompositeActivity's but with more activity fields.
+type DetailedCompositeActivity struct {
+	CompositeActivity
+	D strava.DetailedActivity `json:"activity"`
+}
+
+func showCommand() *command {
+	fs := newFlagSet("show")
+	fs.BoolP("json", "j", false, "JSON output")
+	fs.BoolP("refresh", "r", false, "refetch the activity and ignore cached gear and locations")
+	return &command{
+		name:    "show",
+		summary: "show details of activities",
+		flags:   fs,
+		offline: true,
+		run:     show,
+	}
+}
+
+func show(ctx context.Context, s *sls, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: sls show [flags] <activity ID>...")
+	}
+
+	details := make([]strava.DetailedActivity, 0, len(args))
+	activities := make(strava.Activities, 0, len(args))
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid activity ID %q", arg)
+		}
+		d, err := s.detailedActivity(ctx, id)
+		if err != nil {
+			return fmt.Errorf("couldn't fetch activity %d: %w", id, err)
+		}
+		details = append(details, d)
+		activities = append(activities, d.Activity)
+	}
+
+	gears, err := s.gears(ctx, activities)
+	if err != nil && !degrade(err, "gear") {
+		return err
+	}
+	locations, err := s.startLocations(ctx, activities)
+	if err != nil && !degrade(err, "start locations") {
+		return err
+	}
+
+	dcas := make([]DetailedCompositeActivity, 0, len(details))
+	for i, ca := range compose(activities, gears, locations) {
+		dcas = append(dcas, DetailedCompositeActivity{ca, details[i]})
+	}
+
+	if viper.GetBool("json") {
+		j, err := json.Marshal(dcas)
+		if err != nil {
+			return fmt.Errorf("couldn't marshal to JSON: %w", err)
+		}
+		fmt.Print(string(j))
+		return nil
+	}
+
+	for i, dca := range dcas {
+		if i > 0 {
+			fmt.Println()
+		}
+		for _, line := range formatDetail(dca) {
+			fmt.Println(line)
+		}
+	}
+	return nil
+}
+
+func formatDetail(dca DetailedCompositeActivity) []string {
+	d := dca.D
+	ca := dca.CompositeActivity
+	lines := []string{
+		d.Name,
+		fmt.Sprintf("https://www.strava.com/activities/%d", d.Id),
+		"",
+	}
+
+	fields := make([][2]string, 0)
+	add := func(label, value string) {
+		if value != "" && value != "-" {
+			fields = append(fields, [2]string{label, value})
+		}
+	}
+	add("Date", strings.Replace(strings.TrimSuffix(d.StartDateLocal, "Z"), "T", " ", 1))
+	add("Type", d.Type)
+	add("Gear", formatGear(nil, ca))
+	add("Start", formatStartLocation(nil, ca))
+	add("Distance", fmt.Sprintf("%.1f km", d.Distance/1000))
+	add("Elevation", fmt.Sprintf("%.0f m", d.TotalElevationGain))
+	add("Moving time", formatTime(nil, ca))
+	if d.ElapsedTime > 0 {
+		add("Elapsed time", formatSeconds(d.ElapsedTime))
+	}
+	if d.AverageSpeed > 0 {
+		add("Speed", fmt.Sprintf("%.1f km/h avg, %.1f km/h max", d.AverageSpeed*3.6, d.MaxSpeed*3.6))
+	}
+	if d.DeviceWatts {
+		add("Power", fmt.Sprintf("%.0f W avg, %.0f W weighted, %.0f W max",
+			d.AverageWatts, d.WeightedAverageWatts, d.MaxWatts))
+	} else if d.AverageWatts > 0 {
+		add("Power", fmt.Sprintf("%.0f W avg (estimated)", d.AverageWatts))
+	}
+	if d.DeviceWatts {
+		add("Work", fmt.Sprintf("%.0f kJ", d.Kilojoules))
+	}
+	if d.AverageHeartrate > 0 {
+		add("Heart rate", fmt.Sprintf("%.0f bpm avg, %.0f bpm max", d.AverageHeartrate, d.MaxHeartrate))
+	}
+	if d.AverageCadence > 0 {
+		add("Cadence", fmt.Sprintf("%.0f avg", d.AverageCadence))
+	}
+	if d.Calories > 0 {
+		add("Calories", fmt.Sprintf("%.0f", d.Calories))
+	}
+	add("Device", d.DeviceName)
+	add("External ID", d.ExternalId)
+	flags := make([]string, 0)
+	if d.Commute {
+		flags = append(flags, "commute")
+	}
+	if d.Trainer {
+		flags = append(flags, "trainer")
+	}
+	add("Flags", strings.Join(flags, ", "))
+	add("Achievements", strconv.Itoa(d.AchievementCount))
+	add("Kudos", strconv.Itoa(d.KudosCount))
+
+	width := 0
+	for _, f := range fields {
+		if len(f[0]) > width {
+			width = len(f[0])
+		}
+	}
+	for _, f := range fields {
+		lines = append(lines, fmt.Sprintf("%-*s  %s", width, f[0], f[1]))
+	}
+
+	if d.Description != "" {
+		lines = append(lines, "")
+		lines = append(lines, strings.Split(d.Description, "\n")...)
+	}
+	return lines
+}
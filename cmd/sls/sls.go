@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"sort"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/markdrayton/sls/geo"
 	"github.com/markdrayton/sls/googlemaps"
+	"github.com/markdrayton/sls/store"
 	"github.com/markdrayton/sls/strava"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -28,16 +34,24 @@ type CompositeActivity struct {
 }
 
 type sls struct {
-	athleteId     int64
-	activityCache string
-	gearCache     string
-	locationCache string
-	refreshCache  bool
-	sc            *strava.Client
-	gc            *googlemaps.Client
+	athleteId    int64
+	store        store.Store
+	detailCache  string
+	refreshCache bool
+	offline      bool
+	gearTTL      time.Duration
+	streams      *streamStore
+	sc           *strava.Client
+	gc           *googlemaps.Client
 }
 
-func (s *sls) activities() (strava.Activities, error) {
+// activities returns cached activities merged with any new ones, which are
+// stored as soon as they're fetched. On error, or offline, only the cached
+// activities are returned.
+func (s *sls) activities(ctx context.Context) (strava.Activities, error) {
+	if s.offline {
+		return s.readActivityCache(), nil
+	}
 	var cached strava.Activities
 	if !s.refreshCache {
 		cached = s.readActivityCache()
@@ -48,9 +62,21 @@ func (s *sls) activities() (strava.Activities, error) {
 		epoch = cached[len(cached)-1].StartDate
 	}
 
-	new, err := s.sc.Activities(s.athleteId, epoch)
+	new, err := s.sc.Activities(ctx, s.athleteId, epoch)
 	if err != nil {
-		return nil, err
+		if s.refreshCache {
+			cached = s.readActivityCache()
+		}
+		return cached, err
+	}
+
+	if s.refreshCache {
+		err = s.store.ReplaceActivities(new)
+	} else if len(new) > 0 {
+		err = s.store.PutActivities(new...)
+	}
+	if err != nil {
+		return cached, fmt.Errorf("couldn't store activities: %w", err)
 	}
 
 	all := append(cached, new...)
@@ -74,30 +100,86 @@ func gearIds(activities strava.Activities) []string {
 	return gearIds
 }
 
-func (s *sls) gears(activities strava.Activities) (GearMap, error) {
-	gm := make(GearMap)
-	if !s.refreshCache {
-		gm = s.readGearCache()
+// gears returns cached gear, first fetching any the activities use that
+// isn't cached or was fetched longer than gear_ttl ago, or all of it when
+// refreshing. On error, or offline, the cached gear is still returned.
+func (s *sls) gears(ctx context.Context, activities strava.Activities) (GearMap, error) {
+	gm := s.readGearCache()
+	if s.offline {
+		return gm, nil
 	}
 
 	missing := make([]string, 0)
 	for _, gearId := range gearIds(activities) {
-		_, ok := gm[gearId]
-		if !ok {
+		g, ok := gm[gearId]
+		stale := s.gearTTL > 0 && time.Since(g.FetchedAt) > s.gearTTL
+		if !ok || stale || s.refreshCache {
 			missing = append(missing, gearId)
 		}
 	}
 
-	gears, err := s.sc.Gears(missing)
+	// Store whatever was fetched before an error.
+	gears, err := s.sc.Gears(ctx, missing)
+	for _, gear := range gears {
+		gm[gear.Id] = gear
+	}
+	if putErr := s.store.PutGear(gears...); err == nil && putErr != nil {
+		err = fmt.Errorf("couldn't store gear: %w", putErr)
+	}
+
+	return gm, err
+}
+
+// athleteGears is like gears, but for all the athlete's bikes and shoes as
+// Strava lists them, including gear no cached activity uses, such as
+// retired shoes. The list's name, primary, retired and distance fields are
+// current, so they're laid over the cached details. On error, or offline,
+// all cached gear is returned instead.
+func (s *sls) athleteGears(ctx context.Context) (GearMap, error) {
+	gm := s.readGearCache()
+	if s.offline {
+		return gm, nil
+	}
+	summaries, err := s.sc.AthleteGear(ctx)
 	if err != nil {
 		return gm, err
 	}
 
+	athleteGm := make(GearMap, len(summaries))
+	missing := make([]string, 0)
+	for _, summary := range summaries {
+		g, ok := gm[summary.Id]
+		if ok {
+			g.Name = summary.Name
+			g.Primary = summary.Primary
+			g.Retired = summary.Retired
+			g.Distance = summary.Distance
+		} else {
+			g = summary
+		}
+		athleteGm[g.Id] = g
+		stale := s.gearTTL > 0 && time.Since(g.FetchedAt) > s.gearTTL
+		if !ok || stale || s.refreshCache {
+			missing = append(missing, g.Id)
+		}
+	}
+
+	// Gear that couldn't be fetched keeps its summary.
+	gears, err := s.sc.Gears(ctx, missing)
 	for _, gear := range gears {
-		gm[gear.Id] = gear
+		athleteGm[gear.Id] = gear
+	}
+	changed := make([]strava.Gear, 0)
+	for id, g := range athleteGm {
+		if g != gm[id] {
+			changed = append(changed, g)
+		}
+	}
+	if putErr := s.store.PutGear(changed...); err == nil && putErr != nil {
+		err = fmt.Errorf("couldn't store gear: %w", putErr)
 	}
 
-	return gm, nil
+	return athleteGm, err
 }
 
 func roundedStartLocations(activities strava.Activities) []geo.LatLng {
@@ -113,155 +195,309 @@ func roundedStartLocations(activities strava.Activities) []geo.LatLng {
 	return points
 }
 
-func (s *sls) startLocations(activities strava.Activities) (LocationMap, error) {
-	lm := make(LocationMap)
-	if !s.refreshCache {
-		lm = s.readLocationCache()
+// startLocations is like gears, for geocoded start locations.
+func (s *sls) startLocations(ctx context.Context, activities strava.Activities) (LocationMap, error) {
+	lm := s.readLocationCache()
+	if s.offline {
+		return lm, nil
 	}
 
 	missing := make([]geo.LatLng, 0)
 	// round start locations down to 2km boundaries to reduce the number of API calls
 	for _, point := range roundedStartLocations(activities) {
 		_, ok := lm[point]
-		if !ok {
+		if !ok || s.refreshCache {
 			missing = append(missing, point)
 		}
 	}
 
-	locations, err := s.gc.GeocodePoints(missing)
-	if err != nil {
-		return lm, err
-	}
-
+	locations, err := s.gc.GeocodePoints(ctx, missing)
 	for _, location := range locations {
 		lm[location.LatLng] = location
 	}
+	if putErr := s.store.PutLocations(locations...); err == nil && putErr != nil {
+		err = fmt.Errorf("couldn't store locations: %w", putErr)
+	}
 
-	return lm, nil
+	return lm, err
 }
 
 func (s *sls) readActivityCache() strava.Activities {
-	var activities strava.Activities
-	readCache(s.activityCache, &activities)
+	activities, err := s.store.Activities()
+	if err != nil {
+		log.Printf("Couldn't read activities: %s", err)
+	}
 	return activities
 }
 
-func (s *sls) writeActivityCache(activities strava.Activities) {
-	writeCache(s.activityCache, activities)
-}
-
 func (s *sls) readGearCache() GearMap {
-	gm := make(GearMap)
-	readCache(s.gearCache, &gm)
+	gm, err := s.store.Gear()
+	if err != nil {
+		log.Printf("Couldn't read gear: %s", err)
+		return make(GearMap)
+	}
 	return gm
 }
 
-func (s *sls) writeGearCache(gm GearMap) {
-	writeCache(s.gearCache, gm)
+func (s *sls) readLocationCache() LocationMap {
+	lm, err := s.store.Locations()
+	if err != nil {
+		log.Printf("Couldn't read locations: %s", err)
+		return make(LocationMap)
+	}
+	return lm
 }
 
-func (s *sls) readLocationCache() LocationMap {
-	var locations []googlemaps.GeocodeResult
-	readCache(s.locationCache, &locations)
+// detailedActivity returns the full representation of an activity. These are
+// cached individually as they're fetched.
+func (s *sls) detailedActivity(ctx context.Context, id int64) (strava.DetailedActivity, error) {
+	var d strava.DetailedActivity
+	if (!s.refreshCache || s.offline) && s.readDetailCache(id, &d) {
+		return d, nil
+	}
+	if s.offline {
+		return d, fmt.Errorf("activity %d: %w", id, errNotCached)
+	}
+	d, err := s.sc.Activity(ctx, id)
+	if err != nil {
+		return d, err
+	}
+	s.writeDetailCache(d)
+	return d, nil
+}
 
-	lm := make(LocationMap)
-	for _, location := range locations {
-		lm[location.LatLng] = location
+func (s *sls) detailCachePath(id int64) string {
+	if s.detailCache == "" {
+		return ""
 	}
-	return lm
+	return path.Join(s.detailCache, fmt.Sprintf("%d.json", id))
 }
 
-func (s *sls) writeLocationCache(lm LocationMap) {
-	var locations []googlemaps.GeocodeResult
-	for _, location := range lm {
-		locations = append(locations, location)
+func (s *sls) readDetailCache(id int64, d *strava.DetailedActivity) bool {
+	p := s.detailCachePath(id)
+	if p == "" {
+		return false
+	}
+	if _, err := os.Stat(p); err != nil {
+		return false
 	}
-	writeCache(s.locationCache, locations)
+	return readCache(p, d) == nil
 }
 
-func init() {
-	pflag.BoolP("all", "a", false, "show all columns")
-	pflag.BoolP("power", "p", false, "show power-related columns")
-	pflag.BoolP("start", "s", false, "show start location")
-	pflag.BoolP("time", "t", false, "show activity duration")
-	pflag.BoolP("json", "j", false, "JSON output")
-	pflag.BoolP("refresh", "r", false, "fully refresh cache")
-	pflag.BoolP("debug", "d", false, "debug logging")
-	pflag.CommandLine.SortFlags = false
-	pflag.Parse()
+func (s *sls) writeDetailCache(d strava.DetailedActivity) {
+	if s.detailCache == "" {
+		return
+	}
+	err := os.MkdirAll(s.detailCache, 0755)
+	if err != nil {
+		log.Printf("Couldn't create detail cache directory %s: %s", s.detailCache, err)
+		return
+	}
+	writeCache(s.detailCachePath(d.Id), d)
+}
 
+// compose joins activities with their gear and start locations.
+func compose(activities strava.Activities, gears GearMap, locations LocationMap) []CompositeActivity {
+	compositeActivities := make([]CompositeActivity, 0, len(activities))
+	for _, a := range activities {
+		var gear strava.Gear
+		if _, ok := gears[a.GearId]; ok {
+			gear = gears[a.GearId]
+		}
+		var location googlemaps.GeocodeResult
+		if l, ok := locations[geo.RoundLatLng(a.StartLatLng)]; ok {
+			location = l
+		}
+		compositeActivities = append(compositeActivities, CompositeActivity{a, gear, location})
+	}
+	return compositeActivities
+}
+
+func activitiesOf(cas []CompositeActivity) strava.Activities {
+	activities := make(strava.Activities, 0, len(cas))
+	for _, ca := range cas {
+		activities = append(activities, ca.A)
+	}
+	return activities
+}
+
+// listCommand lists activities, both as sls ls and as plain sls.
+func listCommand(name string) *command {
+	fs := newFlagSet(name)
+	fs.BoolP("all", "a", false, "show all columns")
+	fs.BoolP("power", "p", false, "show power-related columns")
+	fs.BoolP("start", "s", false, "show start location")
+	fs.BoolP("time", "t", false, "show activity duration")
+	fs.BoolP("json", "j", false, "JSON output")
+	fs.BoolP("refresh", "r", false, "fully refresh cache")
+	addFilterFlags(fs)
+	return &command{
+		name:    name,
+		summary: "list activities",
+		flags:   fs,
+		offline: true,
+		run:     list,
+	}
+}
+
+// loadConfig reads config.toml and binds flags. A missing config.toml is
+// only fatal if required is set.
+func loadConfig(flags *pflag.FlagSet, required bool) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		log.Fatalf("Failed to determine home directory")
 	}
 	slsDir := path.Join(homeDir, ".sls")
 	viper.SetConfigFile(path.Join(slsDir, "config.toml"))
+	viper.SetDefault("store_dir", path.Join(slsDir, "store"))
 	viper.SetDefault("activity_cache", path.Join(slsDir, "activities.json"))
 	viper.SetDefault("gear_cache", path.Join(slsDir, "gear.json"))
 	viper.SetDefault("location_cache", path.Join(slsDir, "locations.json"))
+	viper.SetDefault("detail_cache", path.Join(slsDir, "details"))
+	viper.SetDefault("stream_dir", path.Join(slsDir, "streams"))
+	viper.SetDefault("rules_file", path.Join(slsDir, "rules.toml"))
+	viper.SetDefault("components_file", path.Join(slsDir, "components.json"))
+	viper.SetDefault("offline", false)
+	viper.SetDefault("week_start", "monday")
+	viper.SetDefault("gear_ttl", "7d")
+	viper.SetDefault("webhook_listen", "localhost:8080")
+	viper.SetDefault("webhook_path", "/webhook")
 	viper.SetDefault("token_path", path.Join(slsDir, "token"))
+	viper.SetDefault("strava_base_url", strava.DefaultBaseURL)
+	viper.SetDefault("google_maps_base_url", googlemaps.DefaultBaseURL)
+	viper.SetDefault("rate_limit_state", path.Join(slsDir, "ratelimit.json"))
+	viper.SetDefault("checkpoint_dir", path.Join(slsDir, "checkpoint"))
 
 	err = viper.ReadInConfig()
-	if err != nil {
+	if err != nil && (required || !errors.Is(err, os.ErrNotExist)) {
 		log.Fatalf("Couldn't read config: %s", err)
 	}
 
-	viper.BindPFlags(pflag.CommandLine)
+	viper.BindPFlags(flags)
 
 	if viper.GetBool("debug") {
 		log.SetLevel(log.DebugLevel)
 	}
 }
 
-func main() {
-	s := sls{
-		athleteId:     viper.GetInt64("athlete_id"),
-		activityCache: viper.GetString("activity_cache"),
-		gearCache:     viper.GetString("gear_cache"),
-		locationCache: viper.GetString("location_cache"),
-		refreshCache:  viper.GetBool("refresh"),
+func newSls() *sls {
+	offline := viper.GetBool("offline")
+	gearTTL, err := parseDuration(viper.GetString("gear_ttl"))
+	if err != nil {
+		log.Fatalf("Invalid gear_ttl: %s", err)
+	}
+	hc := &http.Client{}
+	if offline {
+		hc.Transport = offlineTransport{}
+	}
+	return &sls{
+		athleteId:    viper.GetInt64("athlete_id"),
+		store:        openStore(),
+		detailCache:  viper.GetString("detail_cache"),
+		refreshCache: viper.GetBool("refresh"),
+		offline:      offline,
+		gearTTL:      gearTTL,
+		streams:      &streamStore{viper.GetString("stream_dir")},
 		sc: strava.NewClient(
 			viper.GetInt("client_id"),
 			viper.GetString("client_secret"),
 			viper.GetString("token_path"),
+			strava.WithBaseURL(viper.GetString("strava_base_url")),
+			strava.WithHTTPClient(hc),
+			strava.WithRateLimitState(viper.GetString("rate_limit_state")),
+			strava.WithCheckpointDir(viper.GetString("checkpoint_dir")),
 		),
 		gc: googlemaps.NewClient(
 			viper.GetString("google_maps_api_key"),
+			googlemaps.WithBaseURL(viper.GetString("google_maps_base_url")),
+			googlemaps.WithHTTPClient(hc),
 		),
 	}
+}
 
-	activities, err := s.activities()
+// openStore opens the store, importing the JSON caches used by earlier
+// versions of sls the first time.
+func openStore() store.Store {
+	dir := viper.GetString("store_dir")
+	st, err := store.Open(dir)
 	if err != nil {
-		log.Fatalf("fatal error: %s", err)
+		log.Fatalf("Couldn't open store in %s: %s", dir, err)
+	}
+	imported, err := store.ImportJSON(st,
+		viper.GetString("activity_cache"),
+		viper.GetString("gear_cache"),
+		viper.GetString("location_cache"))
+	if err != nil {
+		log.Fatalf("Couldn't import caches into %s: %s", dir, err)
+	}
+	if imported {
+		log.Infof("imported caches into %s; the old cache files are no longer used", dir)
 	}
+	return st
+}
 
-	gears, err := s.gears(activities)
+func main() {
+	cmd, args := findCommand(os.Args[1:])
+	addGlobalFlags(cmd.flags)
+	cmd.flags.Parse(args)
+	loadConfig(cmd.flags, !cmd.standalone)
+	if viper.GetBool("offline") && !cmd.offline {
+		log.Fatalf("sls %s needs network access; run it with --offline=false", cmd.name)
+	}
+	var s *sls
+	if !cmd.standalone {
+		s = newSls()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd.run(ctx, s, cmd.flags.Args())
+	if s != nil {
+		s.store.Close()
+	}
 	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Fatal("interrupted")
+		}
+		if errors.Is(err, store.ErrCorrupt) {
+			err = fmt.Errorf("%w (run sls cache repair)", err)
+		}
 		log.Fatalf("fatal error: %s", err)
 	}
+}
 
-	locations, err := s.startLocations(activities)
+func list(ctx context.Context, s *sls, args []string) error {
+	f, err := newActivityFilter()
 	if err != nil {
-		log.Fatalf("fatal error: %s", err)
+		return err
 	}
 
-	compositeActivities := make([]CompositeActivity, 0, len(activities))
-	for _, a := range activities {
-		var gear strava.Gear
-		if _, ok := gears[a.GearId]; ok {
-			gear = gears[a.GearId]
-		}
-		var location googlemaps.GeocodeResult
-		if l, ok := locations[geo.RoundLatLng(a.StartLatLng)]; ok {
-			location = l
-		}
-		compositeActivities = append(compositeActivities, CompositeActivity{a, gear, location})
+	activities, err := s.activities(ctx)
+	if err != nil && !degrade(err, "activities") {
+		return err
+	}
+
+	// Select activities before looking anything up, so that gear and start
+	// locations are only fetched for those shown.
+	activities = f.selectActivities(activities)
+	gears, err := s.gears(ctx, activities)
+	if err != nil && !degrade(err, "gear") {
+		return err
 	}
+	activities = activitiesOf(f.filter(compose(activities, gears, nil)))
+
+	locations, err := s.startLocations(ctx, activities)
+	if err != nil && !degrade(err, "start locations") {
+		return err
+	}
+
+	compositeActivities := compose(activities, gears, locations)
 
 	if viper.GetBool("json") {
 		j, err := json.Marshal(compositeActivities)
 		if err != nil {
-			log.Fatalf("Coudln't marshal to JSON: %s", err)
+			return fmt.Errorf("couldn't marshal to JSON: %w", err)
 		}
 		fmt.Print(string(j))
 	} else {
@@ -277,7 +513,5 @@ func main() {
 		}
 	}
 
-	s.writeActivityCache(activities)
-	s.writeGearCache(gears)
-	s.writeLocationCache(locations)
+	return nil
 }
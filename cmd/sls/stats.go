@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// activityTotals sums a group of activities. Units are Strava's: metres and
+// seconds. Kilojoules only counts activities with power data, and is nil if
+// there are none, in the same way the listing only shows work measured by a
+// power meter.
+type activityTotals struct {
+	Group              map[string]string `json:"group"`
+	Count              int               `json:"count"`
+	Distance           float64           `json:"distance"`
+	TotalElevationGain float64           `json:"total_elevation_gain"`
+	MovingTime         int               `json:"moving_time"`
+	Kilojoules         *float64          `json:"kilojoules"`
+}
+
+func (t *activityTotals) add(ca CompositeActivity) {
+	t.Count++
+	t.Distance += ca.A.Distance
+	t.TotalElevationGain += ca.A.TotalElevationGain
+	t.MovingTime += ca.A.MovingTime
+	if ca.A.DeviceWatts {
+		t.addWork(ca.A.Kilojoules)
+	}
+}
+
+func (t *activityTotals) addWork(kj float64) {
+	if t.Kilojoules == nil {
+		t.Kilojoules = new(float64)
+	}
+	*t.Kilojoules += kj
+}
+
+// A grouping names the group an activity falls in for stats --by.
+type grouping struct {
+	header string
+	key    func(ca CompositeActivity, weekStart time.Weekday) string
+}
+
+var groupings = map[string]grouping{
+	"week": {"Week", func(ca CompositeActivity, weekStart time.Weekday) string {
+		return formatDay(ca, func(day time.Time) string {
+			back := (int(day.Weekday()) - int(weekStart) + 7) % 7
+			return day.AddDate(0, 0, -back).Format("2006-01-02")
+		})
+	}},
+	"month": {"Month", func(ca CompositeActivity, _ time.Weekday) string {
+		return formatDay(ca, func(day time.Time) string { return day.Format("2006-01") })
+	}},
+	"year": {"Year", func(ca CompositeActivity, _ time.Weekday) string {
+		return formatDay(ca, func(day time.Time) string { return day.Format("2006") })
+	}},
+	"type": {"Type", func(ca CompositeActivity, _ time.Weekday) string {
+		return ca.A.Type
+	}},
+	"gear": {"Gear", func(ca CompositeActivity, _ time.Weekday) string {
+		if ca.A.GearId != "" && ca.G.Name == "" {
+			return ca.A.GearId // not cached
+		}
+		return ca.G.Name
+	}},
+}
+
+// formatDay formats the local date an activity started on.
+func formatDay(ca CompositeActivity, format func(day time.Time) string) string {
+	day, ok := startDay(ca.A)
+	if !ok {
+		return "?"
+	}
+	return format(day)
+}
+
+func statsCommand() *command {
+	fs := newFlagSet("stats")
+	addFilterFlags(fs)
+	fs.StringSlice("by", []string{"type"}, "group by these: week, month, year, type or gear")
+	fs.String("week-start", "", "first day of the week for --by week (default week_start from the config)")
+	fs.BoolP("json", "j", false, "JSON output")
+	return &command{
+		name:    "stats",
+		summary: "show activity totals by time period, type or gear",
+		flags:   fs,
+		offline: true,
+		run:     stats,
+	}
+}
+
+func stats(ctx context.Context, s *sls, args []string) error {
+	filter, err := newActivityFilter()
+	if err != nil {
+		return err
+	}
+	by := viper.GetStringSlice("by")
+	if len(by) == 0 {
+		return errors.New("--by needs one or more of week, month, year, type or gear")
+	}
+	for i, name := range by {
+		if _, ok := groupings[name]; !ok {
+			return fmt.Errorf("invalid --by %q; use week, month, year, type or gear", name)
+		}
+		for _, prev := range by[:i] {
+			if name == prev {
+				return fmt.Errorf("--by %s given twice", name)
+			}
+		}
+	}
+	weekStart := viper.GetString("week-start")
+	if weekStart == "" {
+		weekStart = viper.GetString("week_start")
+	}
+	weekday, err := parseWeekday(weekStart)
+	if err != nil {
+		return err
+	}
+
+	activities, err := s.activities(ctx)
+	if err != nil && !degrade(err, "activities") {
+		return err
+	}
+	activities = filter.selectActivities(activities)
+	gears, err := s.gears(ctx, activities)
+	if err != nil && !degrade(err, "gear") {
+		return err
+	}
+
+	groups := make(map[string]*activityTotals)
+	for _, ca := range filter.filter(compose(activities, gears, nil)) {
+		values := make([]string, 0, len(by))
+		for _, name := range by {
+			values = append(values, groupings[name].key(ca, weekday))
+		}
+		key := strings.Join(values, "\x00")
+		t, ok := groups[key]
+		if !ok {
+			t = &activityTotals{Group: make(map[string]string, len(by))}
+			for i, name := range by {
+				t.Group[name] = values[i]
+			}
+			groups[key] = t
+		}
+		t.add(ca)
+	}
+	totals := make([]activityTotals, 0, len(groups))
+	for _, t := range groups {
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		for _, name := range by {
+			a, b := totals[i].Group[name], totals[j].Group[name]
+			if a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+
+	if viper.GetBool("json") {
+		j, err := json.Marshal(totals)
+		if err != nil {
+			return fmt.Errorf("couldn't marshal to JSON: %w", err)
+		}
+		fmt.Print(string(j))
+		return nil
+	}
+
+	for _, line := range formatTotals(by, totals) {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(s, day.String()) || strings.EqualFold(s, day.String()[:3]) {
+			return day, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid week start %q; use a day such as monday or sunday", s)
+}
+
+// formatTotals lays out totals as a table, ending with the overall totals.
+func formatTotals(by []string, totals []activityTotals) []string {
+	row := func(groups []string, t activityTotals) []string {
+		work := "-"
+		if t.Kilojoules != nil {
+			work = fmt.Sprintf("%.0f", *t.Kilojoules)
+		}
+		return append(groups,
+			strconv.Itoa(t.Count),
+			fmt.Sprintf("%.1f", t.Distance/1000),
+			fmt.Sprintf("%.0f", t.TotalElevationGain),
+			formatSeconds(t.MovingTime),
+			work,
+		)
+	}
+
+	header := make([]string, 0, len(by)+5)
+	aligns := make([]alignment, 0, len(by)+5)
+	for _, name := range by {
+		header = append(header, groupings[name].header)
+		aligns = append(aligns, alignLeft)
+	}
+	header = append(header, "Count", "Dist", "Elev", "Time", "Work")
+	aligns = append(aligns, alignRight, alignRight, alignRight, alignRight, alignRight)
+
+	rows := [][]string{header}
+	all := activityTotals{}
+	for _, t := range totals {
+		groups := make([]string, 0, len(by))
+		for _, name := range by {
+			value := t.Group[name]
+			if value == "" {
+				value = "-"
+			}
+			groups = append(groups, value)
+		}
+		rows = append(rows, row(groups, t))
+		all.Count += t.Count
+		all.Distance += t.Distance
+		all.TotalElevationGain += t.TotalElevationGain
+		all.MovingTime += t.MovingTime
+		if t.Kilojoules != nil {
+			all.addWork(*t.Kilojoules)
+		}
+	}
+	groups := make([]string, len(by))
+	groups[0] = "Total"
+	rows = append(rows, row(groups, all))
+	return formatTable(rows, aligns)
+}
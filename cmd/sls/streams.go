@@ -0,0 +1,150 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/markdrayton/sls/internal/atomicfile"
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+// streamStore keeps activity streams as gzipped JSON files named by activity
+// ID. A file is written for every activity whose streams have been fetched,
+// including activities without any streams, so the files also record which
+// activities are done.
+type streamStore struct {
+	dir string
+}
+
+func (ss *streamStore) path(id int64) string {
+	return filepath.Join(ss.dir, fmt.Sprintf("%d.json.gz", id))
+}
+
+func (ss *streamStore) has(id int64) bool {
+	_, err := os.Stat(ss.path(id))
+	return err == nil
+}
+
+func (ss *streamStore) read(id int64) (strava.StreamSet, error) {
+	var streams strava.StreamSet
+	f, err := os.Open(ss.path(id))
+	if err != nil {
+		return streams, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return streams, err
+	}
+	err = json.NewDecoder(zr).Decode(&streams)
+	return streams, err
+}
+
+func (ss *streamStore) write(id int64, streams strava.StreamSet) error {
+	err := os.MkdirAll(ss.dir, 0755)
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(ss.path(id), 0644, func(w io.Writer) error {
+		zw := gzip.NewWriter(w)
+		err := json.NewEncoder(zw).Encode(streams)
+		if err != nil {
+			return err
+		}
+		return zw.Close()
+	})
+}
+
+func streamsCommand() *command {
+	fs := newFlagSet("streams")
+	addFilterFlags(fs)
+	fs.Int("limit", 0, "fetch streams for at most this many activities (default no limit)")
+	return &command{
+		name:    "streams",
+		summary: "download activity streams (streams fetch)",
+		flags:   fs,
+		verbs:   []string{"fetch"},
+		run:     streams,
+	}
+}
+
+func streams(ctx context.Context, s *sls, args []string) error {
+	if len(args) != 1 || args[0] != "fetch" {
+		return errors.New("usage: sls streams fetch [flags]")
+	}
+	f, err := newActivityFilter()
+	if err != nil {
+		return err
+	}
+	return s.fetchStreams(ctx, f, viper.GetInt("limit"))
+}
+
+// fetchStreams downloads streams for cached activities matching f, newest
+// first, skipping activities already in the stream store. It stops cleanly
+// when the daily rate limit is reached so that a later run can carry on.
+func (s *sls) fetchStreams(ctx context.Context, f *activityFilter, limit int) error {
+	cas := f.filter(compose(s.readActivityCache(), s.readGearCache(), nil))
+	pending := make([]CompositeActivity, 0)
+	for i := len(cas) - 1; i >= 0; i-- {
+		if !s.streams.has(cas[i].A.Id) {
+			pending = append(pending, cas[i])
+		}
+	}
+	total := len(pending)
+	if limit > 0 && len(pending) > limit {
+		pending = pending[:limit]
+	}
+
+	fetched := 0
+	defer func() {
+		fmt.Printf("Fetched streams for %d activities; %d remaining\n", fetched, total-fetched)
+	}()
+
+	for _, ca := range pending {
+		a := ca.A
+		_, err := s.activityStreams(ctx, a.Id)
+		if errors.Is(err, strava.ErrRateLimited) {
+			log.Warnf("stopping: %s", err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't fetch streams for activity %d: %w", a.Id, err)
+		}
+		fetched++
+		fmt.Printf("%s  %d  %s\n", formatStartDate(a), a.Id, a.Name)
+	}
+	return nil
+}
+
+// activityStreams returns an activity's streams from the stream store,
+// fetching and storing them first if they aren't there.
+func (s *sls) activityStreams(ctx context.Context, id int64) (strava.StreamSet, error) {
+	if s.streams.has(id) {
+		return s.streams.read(id)
+	}
+	if s.offline {
+		return strava.StreamSet{}, fmt.Errorf("streams: %w", errNotCached)
+	}
+
+	streams, err := s.sc.Streams(ctx, id)
+	if errors.Is(err, strava.ErrNotFound) {
+		// Nothing to fetch. Store an empty set so the activity isn't tried
+		// again.
+		log.Debugf("activity %d has no streams", id)
+		err = nil
+	}
+	if err != nil {
+		return streams, err
+	}
+	return streams, s.streams.write(id, streams)
+}
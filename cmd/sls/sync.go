@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+type changeKind int
+
+const (
+	changeAdded changeKind = iota
+	changeDeleted
+	changeRenamed
+	changeGear
+	changeType
+	changeUpdated
+)
+
+var changeKindNames = []string{"added", "deleted", "renamed", "regeared", "retyped", "updated"}
+
+func (k changeKind) String() string {
+	return changeKindNames[k]
+}
+
+// activityChange describes how a cached activity differs from Strava's copy.
+// An activity with several changed fields has one change of each kind.
+type activityChange struct {
+	kind   changeKind
+	old    strava.Activity
+	new    strava.Activity
+	detail string
+}
+
+func syncCommand() *command {
+	fs := newFlagSet("sync")
+	fs.BoolP("refresh", "r", false, "fully refresh cache")
+	fs.Bool("verify", false, "refetch recent activities to find edits and deletions")
+	fs.String("since", "90d", "how far back --verify looks")
+	return &command{
+		name:    "sync",
+		summary: "update the caches without listing activities",
+		flags:   fs,
+		run:     syncActivities,
+	}
+}
+
+func syncActivities(ctx context.Context, s *sls, args []string) error {
+	activities, err := s.activities(ctx)
+	if err != nil {
+		return err
+	}
+
+	verify := viper.GetBool("verify")
+	var changes []activityChange
+	var after time.Time
+	if verify {
+		since, err := parseDuration(viper.GetString("since"))
+		if err != nil {
+			return err
+		}
+		after = time.Now().Add(-since)
+		activities, changes, err = s.verify(ctx, activities, after)
+		if err != nil {
+			return err
+		}
+		err = s.storeVerified(activities, changes, after)
+		if err != nil {
+			return err
+		}
+	}
+
+	gears, err := s.gears(ctx, activities)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.startLocations(ctx, activities)
+	if err != nil {
+		return err
+	}
+
+	for i := range changes {
+		if changes[i].kind == changeGear {
+			changes[i].detail = fmt.Sprintf("%s -> %s",
+				gearName(gears, changes[i].old.GearId), gearName(gears, changes[i].new.GearId))
+		}
+	}
+
+	if verify {
+		printChanges(changes, after)
+	}
+	return warnWornComponents(activities, gears)
+}
+
+// verify refetches the activities that started after the given time and
+// reconciles them with the cached ones. It returns the updated activities
+// and the changes made. On error the activities are returned unchanged.
+func (s *sls) verify(ctx context.Context, activities strava.Activities, after time.Time) (strava.Activities, []activityChange, error) {
+	fresh, err := s.sc.ActivitiesBetween(ctx, s.athleteId, after, time.Now())
+	if err != nil {
+		return activities, nil, err
+	}
+
+	freshById := make(map[int64]strava.Activity, len(fresh))
+	for _, a := range fresh {
+		freshById[a.Id] = a
+	}
+
+	changes := make([]activityChange, 0)
+	verified := make(strava.Activities, 0, len(activities))
+	seen := make(map[int64]bool)
+	for _, old := range activities {
+		if !old.StartDate.After(after) {
+			verified = append(verified, old)
+			continue
+		}
+		if seen[old.Id] {
+			continue // drop duplicates
+		}
+		seen[old.Id] = true
+		new, ok := freshById[old.Id]
+		if !ok {
+			changes = append(changes, activityChange{kind: changeDeleted, old: old})
+			continue
+		}
+		changes = append(changes, diffActivity(old, new)...)
+		verified = append(verified, new)
+	}
+
+	// Activities Strava has that the cache doesn't: uploaded late with an
+	// earlier start date, or moved into the window by an edit.
+	for _, new := range fresh {
+		if !seen[new.Id] {
+			changes = append(changes, activityChange{kind: changeAdded, new: new})
+			verified = append(verified, new)
+		}
+	}
+
+	sort.Sort(verified)
+	return verified, changes, nil
+}
+
+// storeVerified stores the activities verify refetched, including those
+// with changes only to fields it doesn't compare, and removes the deleted
+// ones.
+func (s *sls) storeVerified(verified strava.Activities, changes []activityChange, after time.Time) error {
+	deleted := make([]int64, 0)
+	for _, c := range changes {
+		if c.kind == changeDeleted {
+			deleted = append(deleted, c.old.Id)
+		}
+	}
+	fresh := make(strava.Activities, 0)
+	for _, a := range verified {
+		if a.StartDate.After(after) {
+			fresh = append(fresh, a)
+		}
+	}
+	err := s.store.DeleteActivities(deleted...)
+	if err == nil {
+		err = s.store.PutActivities(fresh...)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't store changes: %w", err)
+	}
+	return nil
+}
+
+func diffActivity(old, new strava.Activity) []activityChange {
+	changes := make([]activityChange, 0)
+	if old.Name != new.Name {
+		changes = append(changes, activityChange{
+			kind:   changeRenamed,
+			detail: fmt.Sprintf("%q -> %q", old.Name, new.Name),
+		})
+	}
+	if old.GearId != new.GearId {
+		// Detail is filled in once gear names are known.
+		changes = append(changes, activityChange{kind: changeGear})
+	}
+	if old.Type != new.Type {
+		changes = append(changes, activityChange{
+			kind:   changeType,
+			detail: fmt.Sprintf("%s -> %s", old.Type, new.Type),
+		})
+	}
+	if len(changes) == 0 && !sameFields(old, new) {
+		changes = append(changes, activityChange{kind: changeUpdated})
+	}
+	for i := range changes {
+		changes[i].old = old
+		changes[i].new = new
+	}
+	return changes
+}
+
+// sameFields reports whether two activities' typed fields are equal.
+func sameFields(a, b strava.Activity) bool {
+	a.Raw, b.Raw = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+func printChanges(changes []activityChange, after time.Time) {
+	counts := make([]int, len(changeKindNames))
+	for _, c := range changes {
+		counts[c.kind]++
+		a := c.new
+		if c.kind == changeDeleted {
+			a = c.old
+		}
+		line := fmt.Sprintf("%-8s %s  %d  %s", c.kind, formatStartDate(a), a.Id, a.Name)
+		if c.detail != "" {
+			line += ": " + c.detail
+		}
+		fmt.Println(line)
+	}
+
+	summary := make([]string, 0)
+	for kind, n := range counts {
+		if n > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", n, changeKind(kind)))
+		}
+	}
+	if len(summary) == 0 {
+		summary = append(summary, "no changes")
+	}
+	fmt.Printf("Verified activities since %s: %s\n", after.Format("2006-01-02"), strings.Join(summary, ", "))
+}
+
+func gearName(gears GearMap, id string) string {
+	if id == "" {
+		return "-"
+	}
+	if g, ok := gears[id]; ok && g.Name != "" {
+		return g.Name
+	}
+	return id
+}
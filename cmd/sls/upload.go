@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+func uploadCommand() *command {
+	fs := newFlagSet("upload")
+	fs.String("name", "", "activity name (default chosen by Strava)")
+	fs.String("description", "", "activity description")
+	fs.Bool("commute", false, "mark as a commute")
+	fs.Bool("trainer", false, "mark as a trainer activity")
+	return &command{
+		name:    "upload",
+		summary: "upload FIT, TCX or GPX files as new activities",
+		flags:   fs,
+		run:     upload,
+	}
+}
+
+func upload(ctx context.Context, s *sls, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: sls upload [flags] <file>...")
+	}
+	params := strava.UploadParams{
+		Name:        viper.GetString("name"),
+		Description: viper.GetString("description"),
+		Commute:     viper.GetBool("commute"),
+		Trainer:     viper.GetBool("trainer"),
+	}
+
+	uploaded := make(strava.Activities, 0, len(args))
+	duplicates, failed := 0, 0
+	var err error
+	for _, file := range args {
+		var a strava.Activity
+		a, err = s.uploadFile(ctx, file, params)
+		var uploadErr *strava.UploadError
+		if errors.As(err, &uploadErr) && uploadErr.DuplicateOf != 0 {
+			fmt.Printf("%s: duplicate of activity %d\n", file, uploadErr.DuplicateOf)
+			duplicates++
+			err = nil
+			continue
+		}
+		if errors.Is(err, strava.ErrUnauthorized) {
+			err = fmt.Errorf("%w (run sls auth to allow sls to upload activities)", err)
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, strava.ErrRateLimited) ||
+			errors.Is(err, strava.ErrUnauthorized) {
+			// Later files would fail the same way.
+			err = fmt.Errorf("%s: %w", file, err)
+			break
+		}
+		if err != nil {
+			log.Errorf("%s: %s", file, err)
+			failed++
+			err = nil
+			continue
+		}
+		fmt.Printf("%s: %s  %d  %s\n", file, formatStartDate(a), a.Id, a.Name)
+		uploaded = append(uploaded, a)
+	}
+
+	if len(uploaded) > 0 {
+		s.cacheNewActivities(ctx, uploaded)
+	}
+	fmt.Printf("Uploaded %d of %d files", len(uploaded), len(args))
+	if duplicates > 0 {
+		fmt.Printf("; %d duplicates", duplicates)
+	}
+	if failed > 0 {
+		fmt.Printf("; %d failed", failed)
+	}
+	fmt.Println()
+	if err == nil && failed > 0 {
+		err = errors.New("some files couldn't be uploaded")
+	}
+	return err
+}
+
+// uploadFile uploads a file and waits for Strava to turn it into an
+// activity.
+func (s *sls) uploadFile(ctx context.Context, file string, params strava.UploadParams) (strava.Activity, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return strava.Activity{}, err
+	}
+	upload, err := s.sc.Upload(ctx, file, data, params)
+	if err == nil {
+		log.Infof("%s: uploaded, waiting for Strava to process it", file)
+		upload, err = s.sc.WaitForUpload(ctx, upload)
+	}
+	if err != nil {
+		return strava.Activity{}, err
+	}
+
+	d, err := s.sc.Activity(ctx, upload.ActivityId)
+	if err != nil {
+		return strava.Activity{}, fmt.Errorf("couldn't fetch new activity %d: %w", upload.ActivityId, err)
+	}
+	s.writeDetailCache(d)
+	return d.Summary(), nil
+}
+
+// cacheNewActivities adds newly created activities to the store.
+// Other new activities are fetched first as usual; activities newer than
+// every cached one are left for that, since caching one early would stop
+// activities recorded before it from being fetched. Older activities, such
+// as uploaded old rides, would never be fetched, so are added directly.
+func (s *sls) cacheNewActivities(ctx context.Context, created strava.Activities) strava.Activities {
+	activities, err := s.activities(ctx)
+	if err != nil {
+		log.Warnf("couldn't fetch new activities: %s", err)
+	}
+	if len(activities) == 0 {
+		// Without a cache the next run fetches everything anyway.
+		return activities
+	}
+
+	cached := make(map[int64]bool, len(activities))
+	for _, a := range activities {
+		cached[a.Id] = true
+	}
+	latest := activities[len(activities)-1].StartDate
+	added := make(strava.Activities, 0, len(created))
+	for _, a := range created {
+		if !cached[a.Id] && !a.StartDate.After(latest) {
+			added = append(added, a)
+		}
+	}
+	err = s.store.PutActivities(added...)
+	if err != nil {
+		log.Warnf("couldn't store new activities: %s", err)
+		return activities
+	}
+	activities = append(activities, added...)
+	sort.Sort(activities)
+	return activities
+}
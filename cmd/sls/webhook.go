@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/spf13/viper"
+)
+
+// Events waiting to be processed. Beyond this the webhook handler asks
+// Strava to try again later.
+const webhookQueueSize = 100
+
+func serveWebhookCommand() *command {
+	fs := newFlagSet("serve-webhook")
+	fs.String("listen", "", "address to listen on (default webhook_listen from the config)")
+	return &command{
+		name:    "serve-webhook",
+		summary: "keep the caches up to date from Strava webhook events",
+		flags:   fs,
+		run:     serveWebhook,
+	}
+}
+
+func webhookCommand() *command {
+	fs := newFlagSet("webhook")
+	fs.String("callback-url", "", "public URL of sls serve-webhook (default webhook_callback_url from the config)")
+	return &command{
+		name:    "webhook",
+		summary: "manage the webhook subscription (webhook subscribe|list|unsubscribe)",
+		flags:   fs,
+		verbs:   []string{"subscribe", "list", "unsubscribe"},
+		run:     webhook,
+	}
+}
+
+func serveWebhook(ctx context.Context, s *sls, args []string) error {
+	verifyToken := viper.GetString("webhook_verify_token")
+	if verifyToken == "" {
+		return errors.New("set webhook_verify_token in the config to a secret string")
+	}
+	listen := viper.GetString("listen")
+	if listen == "" {
+		listen = viper.GetString("webhook_listen")
+	}
+
+	events := make(chan strava.WebhookEvent, webhookQueueSize)
+	mux := http.NewServeMux()
+	mux.Handle(viper.GetString("webhook_path"),
+		strava.NewWebhookHandler(verifyToken, viper.GetInt64("webhook_subscription_id"), events))
+	srv := &http.Server{Addr: listen, Handler: mux}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	log.Infof("listening for webhook events on %s%s", listen, viper.GetString("webhook_path"))
+
+	for {
+		select {
+		case event := <-events:
+			err := s.handleEvent(ctx, event)
+			if err != nil {
+				log.Errorf("couldn't handle %s %s event for %d: %s",
+					event.ObjectType, event.AspectType, event.ObjectId, err)
+			}
+		case err := <-serveErr:
+			return err
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+			return ctx.Err()
+		}
+	}
+}
+
+// handleEvent applies a webhook event to the caches.
+func (s *sls) handleEvent(ctx context.Context, event strava.WebhookEvent) error {
+	log.Debugf("event: %+v", event)
+	if event.OwnerId != s.athleteId {
+		log.Debugf("ignoring event for athlete %d", event.OwnerId)
+		return nil
+	}
+	switch {
+	case event.Deauthorized():
+		log.Warnf("athlete %d revoked sls's access to Strava; run sls auth to restore it", event.OwnerId)
+		return nil
+	case event.ObjectType != strava.ObjectActivity:
+		return nil
+	case event.AspectType == strava.AspectDelete:
+		s.forgetActivity(event.ObjectId)
+		return nil
+	}
+	return s.refreshActivity(ctx, event.ObjectId, event.AspectType == strava.AspectCreate)
+}
+
+// refreshActivity refetches an activity and updates it in the caches, adding
+// it if it's new and fetching its gear if that isn't cached.
+func (s *sls) refreshActivity(ctx context.Context, id int64, created bool) error {
+	d, err := s.sc.Activity(ctx, id)
+	if errors.Is(err, strava.ErrNotFound) {
+		// Deleted since, or made private without activity:read_all.
+		s.forgetActivity(id)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.writeDetailCache(d)
+
+	_, found, err := s.store.Activity(id)
+	if err != nil {
+		return err
+	}
+	activities := strava.Activities{d.Summary()}
+	if found {
+		err = s.store.PutActivities(activities...)
+		if err != nil {
+			return err
+		}
+		log.Infof("updated activity %d: %s", id, d.Name)
+	} else {
+		activities = s.cacheNewActivities(ctx, activities)
+		log.Infof("added activity %d: %s", id, d.Name)
+	}
+
+	_, err = s.gears(ctx, activities)
+	return err
+}
+
+// forgetActivity removes an activity from the store and the detail cache.
+// Its streams are kept.
+func (s *sls) forgetActivity(id int64) {
+	_, found, err := s.store.Activity(id)
+	if err == nil && found {
+		err = s.store.DeleteActivities(id)
+		if err == nil {
+			log.Infof("deleted activity %d", id)
+		}
+	}
+	if err != nil {
+		log.Errorf("couldn't delete activity %d: %s", id, err)
+	}
+	if p := s.detailCachePath(id); p != "" {
+		os.Remove(p)
+	}
+}
+
+func webhook(ctx context.Context, s *sls, args []string) error {
+	usage := errors.New("usage: sls webhook subscribe [--callback-url URL]\n" +
+		"       sls webhook list\n" +
+		"       sls webhook unsubscribe [subscription ID]")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "subscribe":
+		callbackURL := viper.GetString("callback-url")
+		if callbackURL == "" {
+			callbackURL = viper.GetString("webhook_callback_url")
+		}
+		verifyToken := viper.GetString("webhook_verify_token")
+		if callbackURL == "" || verifyToken == "" {
+			return errors.New("set webhook_callback_url and webhook_verify_token in the config")
+		}
+		sub, err := s.sc.Subscribe(ctx, callbackURL, verifyToken)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Subscribed to events at %s\n", sub.CallbackURL)
+		fmt.Printf("Set webhook_subscription_id = %d in %s to reject events for other subscriptions\n",
+			sub.Id, viper.ConfigFileUsed())
+	case "list":
+		subs, err := s.sc.Subscriptions(ctx)
+		if err != nil {
+			return err
+		}
+		for _, sub := range subs {
+			fmt.Printf("%d  %s  %s\n", sub.Id, sub.CreatedAt.Format("2006-01-02"), sub.CallbackURL)
+		}
+	case "unsubscribe":
+		var ids []int64
+		if len(args) > 1 {
+			id, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid subscription ID %q", args[1])
+			}
+			ids = append(ids, id)
+		} else {
+			subs, err := s.sc.Subscriptions(ctx)
+			if err != nil {
+				return err
+			}
+			for _, sub := range subs {
+				ids = append(ids, sub.Id)
+			}
+		}
+		for _, id := range ids {
+			err := s.sc.Unsubscribe(ctx, id)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Deleted subscription %d\n", id)
+		}
+	default:
+		return usage
+	}
+	return nil
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/markdrayton/sls/strava"
+)
+
+// A --where expression is a condition on activities, e.g.
+//
+//	type in (Ride, VirtualRide) && dist > 100km && gear =~ /R3/ && date >= 2023-01-01
+//
+// Conditions compare a field with a literal and combine with &&, ||, ! and
+// parentheses (or and, or, not). Literals are read according to the field:
+// distances need a unit (m, km, mi, ft), durations are like 1h30m or 2d, and
+// dates are YYYY-MM-DD. Strings compare case-insensitively and can be
+// quoted; =~ and !~ match a /regular expression/. Fields of the raw activity
+// are available as raw.<name>.
+
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindNumber
+	kindDistance // metres
+	kindDuration // seconds
+	kindDate     // Unix time of the local start date
+	kindBool
+	kindRaw // whatever the JSON holds
+)
+
+// whereField reads a field of an activity as a string, float64 or bool.
+type whereField struct {
+	kind fieldKind
+	get  func(ca CompositeActivity) interface{}
+}
+
+var whereFields = map[string]whereField{
+	"id":          {kindNumber, func(ca CompositeActivity) interface{} { return float64(ca.A.Id) }},
+	"name":        {kindString, func(ca CompositeActivity) interface{} { return ca.A.Name }},
+	"type":        {kindString, func(ca CompositeActivity) interface{} { return ca.A.Type }},
+	"gear":        {kindString, func(ca CompositeActivity) interface{} { return ca.G.Name }},
+	"gear_id":     {kindString, func(ca CompositeActivity) interface{} { return ca.A.GearId }},
+	"external_id": {kindString, func(ca CompositeActivity) interface{} { return ca.A.ExternalId }},
+	"dist":        {kindDistance, func(ca CompositeActivity) interface{} { return ca.A.Distance }},
+	"elev":        {kindDistance, func(ca CompositeActivity) interface{} { return ca.A.TotalElevationGain }},
+	"time":        {kindDuration, func(ca CompositeActivity) interface{} { return float64(ca.A.MovingTime) }},
+	"date":        {kindDate, func(ca CompositeActivity) interface{} { return localDate(ca.A) }},
+	"work":        {kindNumber, func(ca CompositeActivity) interface{} { return ca.A.Kilojoules }},
+	"power":       {kindNumber, func(ca CompositeActivity) interface{} { return ca.A.AverageWatts }},
+	"commute":     {kindBool, func(ca CompositeActivity) interface{} { return ca.A.Commute }},
+	"trainer":     {kindBool, func(ca CompositeActivity) interface{} { return ca.A.Trainer }},
+}
+
+const rawPrefix = "raw."
+
+func rawField(name string) whereField {
+	return whereField{kindRaw, func(ca CompositeActivity) interface{} {
+		var v interface{}
+		if ok, err := ca.A.Field(name, &v); !ok || err != nil {
+			return nil
+		}
+		return v
+	}}
+}
+
+func localDate(a strava.Activity) interface{} {
+	day, ok := startDay(a)
+	if !ok {
+		return math.NaN()
+	}
+	return float64(day.Unix())
+}
+
+// whereExpr is a parsed --where expression.
+type whereExpr interface {
+	eval(ca CompositeActivity) bool
+}
+
+type andExpr struct{ l, r whereExpr }
+
+func (e andExpr) eval(ca CompositeActivity) bool { return e.l.eval(ca) && e.r.eval(ca) }
+
+type orExpr struct{ l, r whereExpr }
+
+func (e orExpr) eval(ca CompositeActivity) bool { return e.l.eval(ca) || e.r.eval(ca) }
+
+type notExpr struct{ e whereExpr }
+
+func (e notExpr) eval(ca CompositeActivity) bool { return !e.e.eval(ca) }
+
+// comparison compares a field with one value, or with several for "in".
+type comparison struct {
+	field  whereField
+	op     string
+	values []interface{}
+	re     *regexp.Regexp
+}
+
+func (c comparison) eval(ca CompositeActivity) bool {
+	v := c.field.get(ca)
+	switch c.op {
+	case "=~", "!~":
+		s, ok := v.(string)
+		return ok && c.re.MatchString(s) == (c.op == "=~")
+	case "=", "==", "in":
+		for _, want := range c.values {
+			if equalValues(v, want) {
+				return true
+			}
+		}
+		return false
+	case "!=":
+		return v != nil && !equalValues(v, c.values[0])
+	}
+
+	n, ok := v.(float64)
+	want, wantOk := c.values[0].(float64)
+	if !ok || !wantOk {
+		return false
+	}
+	switch c.op {
+	case "<":
+		return n < want
+	case "<=":
+		return n <= want
+	case ">":
+		return n > want
+	case ">=":
+		return n >= want
+	}
+	return false
+}
+
+func equalValues(a, b interface{}) bool {
+	if s, ok := a.(string); ok {
+		t, ok := b.(string)
+		return ok && strings.EqualFold(s, t)
+	}
+	return a == b
+}
+
+type tokenKind int
+
+const (
+	tokEOF    tokenKind = iota
+	tokWord             // field names, keywords and unquoted literals
+	tokString           // quoted
+	tokRegexp           // /.../
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var whereOps = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "=", "<", ">", "!", "(", ")", ","}
+
+// Characters that end an unquoted word.
+const wordBreaks = "()!,=<>&|'\"/~"
+
+func lexWhere(src string) ([]token, error) {
+	tokens := make([]token, 0)
+	i := 0
+outer:
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case isSpace(src[i]):
+			i++
+			continue
+		case c == '\'' || c == '"' || c == '/':
+			kind := tokString
+			if c == '/' {
+				kind = tokRegexp
+			}
+			text, n, err := lexQuoted(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("position %d: %s", i+1, err)
+			}
+			tokens = append(tokens, token{kind, text, i})
+			i += n
+			continue
+		}
+		for _, op := range whereOps {
+			if strings.HasPrefix(src[i:], op) {
+				tokens = append(tokens, token{tokOp, op, i})
+				i += len(op)
+				continue outer
+			}
+		}
+		start := i
+		for i < len(src) && !isSpace(src[i]) && !strings.ContainsRune(wordBreaks, rune(src[i])) {
+			i++
+		}
+		if i == start {
+			return nil, fmt.Errorf("position %d: unexpected %q", i+1, src[i])
+		}
+		tokens = append(tokens, token{tokWord, src[start:i], start})
+	}
+	return append(tokens, token{tokEOF, "", len(src)}), nil
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// lexQuoted reads a string or regular expression delimited by its first
+// character, returning its contents and length. A backslash escapes the
+// delimiter; in strings it also escapes itself, and regular expressions keep
+// their other escapes.
+func lexQuoted(src string) (string, int, error) {
+	delim := src[0]
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == delim:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(src) && (src[i+1] == delim || (delim != '/' && src[i+1] == '\\')):
+			i++
+			c = src[i]
+		}
+		b.WriteByte(c)
+	}
+	return "", 0, fmt.Errorf("unterminated %c", delim)
+}
+
+type whereParser struct {
+	tokens []token
+	i      int
+}
+
+// parseWhere parses a --where expression, rejecting unknown fields and
+// literals that don't suit their field.
+func parseWhere(src string) (whereExpr, error) {
+	tokens, err := lexWhere(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &whereParser{tokens: tokens}
+	if p.peek().kind == tokEOF {
+		return nil, errors.New("empty expression")
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return e, nil
+}
+
+func (p *whereParser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *whereParser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// accept consumes the next token if it's one of the given operators or
+// keywords.
+func (p *whereParser) accept(texts ...string) bool {
+	t := p.peek()
+	if t.kind != tokOp && t.kind != tokWord {
+		return false
+	}
+	for _, text := range texts {
+		if t.text == text {
+			p.i++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *whereParser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("position %d: %s", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *whereParser) parseOr() (whereExpr, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.accept("||", "or") {
+		var r whereExpr
+		r, err = p.parseAnd()
+		l = orExpr{l, r}
+	}
+	return l, err
+}
+
+func (p *whereParser) parseAnd() (whereExpr, error) {
+	l, err := p.parseUnary()
+	for err == nil && p.accept("&&", "and") {
+		var r whereExpr
+		r, err = p.parseUnary()
+		l = andExpr{l, r}
+	}
+	return l, err
+}
+
+func (p *whereParser) parseUnary() (whereExpr, error) {
+	if p.accept("!", "not") {
+		e, err := p.parseUnary()
+		return notExpr{e}, err
+	}
+	if p.accept("(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t.kind != tokOp || t.text != ")" {
+			return nil, p.errorf(t, "expected )")
+		}
+		return e, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *whereParser) parseComparison() (whereExpr, error) {
+	t := p.next()
+	if t.kind != tokWord {
+		return nil, p.errorf(t, "expected a field")
+	}
+	field, ok := whereFields[t.text]
+	if strings.HasPrefix(t.text, rawPrefix) && len(t.text) > len(rawPrefix) {
+		field, ok = rawField(strings.TrimPrefix(t.text, rawPrefix)), true
+	}
+	if !ok {
+		return nil, p.errorf(t, "unknown field %q (fields are %s and raw.<name>)", t.text, fieldNames())
+	}
+
+	c := comparison{field: field}
+	opToken := p.peek()
+	switch {
+	case p.accept("in"):
+		c.op = "in"
+		if t := p.next(); t.kind != tokOp || t.text != "(" {
+			return nil, p.errorf(t, "expected ( after in")
+		}
+		for {
+			v, err := p.parseValue(t.text, field)
+			if err != nil {
+				return nil, err
+			}
+			c.values = append(c.values, v)
+			if p.accept(")") {
+				break
+			}
+			if !p.accept(",") {
+				return nil, p.errorf(p.peek(), "expected , or )")
+			}
+		}
+	case p.accept("=~", "!~"):
+		c.op = opToken.text
+		if field.kind != kindString && field.kind != kindRaw {
+			return nil, p.errorf(opToken, "%s can't be matched with %s", t.text, c.op)
+		}
+		re := p.next()
+		if re.kind != tokRegexp && re.kind != tokString {
+			return nil, p.errorf(re, "expected a /regular expression/")
+		}
+		var err error
+		c.re, err = regexp.Compile(re.text)
+		if err != nil {
+			return nil, p.errorf(re, "invalid regular expression: %s", err)
+		}
+	case p.accept("=", "==", "!="):
+		c.op = opToken.text
+		v, err := p.parseValue(t.text, field)
+		if err != nil {
+			return nil, err
+		}
+		c.values = []interface{}{v}
+	case p.accept("<", "<=", ">", ">="):
+		c.op = opToken.text
+		if field.kind == kindString || field.kind == kindBool {
+			return nil, p.errorf(opToken, "%s can't be compared with %s", t.text, c.op)
+		}
+		v, err := p.parseValue(t.text, field)
+		if err != nil {
+			return nil, err
+		}
+		c.values = []interface{}{v}
+	case field.kind == kindBool:
+		// A bare boolean field is true when set.
+		c.op = "="
+		c.values = []interface{}{true}
+	default:
+		return nil, p.errorf(opToken, "expected an operator after %s", t.text)
+	}
+	return c, nil
+}
+
+// parseValue reads a literal for the named field.
+func (p *whereParser) parseValue(name string, field whereField) (interface{}, error) {
+	t := p.next()
+	if t.kind != tokWord && t.kind != tokString {
+		return nil, p.errorf(t, "expected a value for %s", name)
+	}
+	if t.kind == tokString && field.kind != kindString && field.kind != kindRaw {
+		return nil, p.errorf(t, "%s isn't a string", name)
+	}
+
+	var v interface{}
+	var err error
+	switch field.kind {
+	case kindString:
+		v = t.text
+	case kindNumber:
+		v, err = strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			err = errors.New("invalid number")
+		}
+	case kindDistance:
+		v, err = parseDistance(t.text)
+	case kindDuration:
+		var d time.Duration
+		d, err = parseDuration(t.text)
+		v = d.Seconds()
+	case kindDate:
+		var d time.Time
+		d, err = time.Parse("2006-01-02", t.text)
+		v = float64(d.Unix())
+		if err != nil {
+			err = errors.New("invalid date; use YYYY-MM-DD")
+		}
+	case kindBool:
+		v, err = strconv.ParseBool(t.text)
+		if err != nil {
+			err = errors.New("expected true or false")
+		}
+	case kindRaw:
+		v = rawValue(t)
+	}
+	if err != nil {
+		return nil, p.errorf(t, "%s %q: %s", name, t.text, err)
+	}
+	return v, nil
+}
+
+// rawValue reads a literal compared with a raw field as the JSON it would
+// be.
+func rawValue(t token) interface{} {
+	if t.kind == tokWord {
+		var v interface{}
+		if err := json.Unmarshal([]byte(t.text), &v); err == nil {
+			switch v.(type) {
+			case float64, bool:
+				return v
+			}
+		}
+	}
+	return t.text
+}
+
+var distanceUnits = []struct {
+	suffix string
+	metres float64
+}{
+	{"km", 1000},
+	{"mi", 1609.344},
+	{"ft", 0.3048},
+	{"m", 1},
+}
+
+// parseDistance reads a distance with a unit, returning metres.
+func parseDistance(s string) (float64, error) {
+	for _, unit := range distanceUnits {
+		if !strings.HasSuffix(s, unit.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, unit.suffix), 64)
+		if err == nil {
+			return n * unit.metres, nil
+		}
+	}
+	return 0, errors.New("invalid distance; give a unit: m, km, mi or ft")
+}
+
+func fieldNames() string {
+	names := make([]string, 0, len(whereFields))
+	for name := range whereFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/markdrayton/sls/strava"
+)
+
+var whereActivity = CompositeActivity{
+	A: strava.Activity{
+		Id:                 1234,
+		Name:               "Morning Ride",
+		Type:               "Ride",
+		GearId:             "b1",
+		ExternalId:         "garmin_push_1",
+		Distance:           102500,
+		TotalElevationGain: 850,
+		MovingTime:         4*3600 + 15*60,
+		StartDate:          time.Date(2023, 3, 4, 23, 30, 0, 0, time.UTC),
+		StartDateLocal:     "2023-03-05T08:30:00Z",
+		Kilojoules:         2400,
+		AverageWatts:       180,
+		Commute:            true,
+		Raw:                json.RawMessage(`{"kudos_count": 12, "private": false, "device_name": "Garmin Edge 530"}`),
+	},
+	G: strava.Gear{Id: "b1", Name: "R3"},
+}
+
+func TestWhere(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// Fields and units.
+		{"type = ride", true},
+		{"type == Run", false},
+		{"type != Run", true},
+		{"dist > 100km", true},
+		{"dist > 64mi", false},
+		{"dist >= 102500m", true},
+		{"elev < 2800ft", true},
+		{"time > 4h", true},
+		{"time < 4h30m", true},
+		{"time >= 1d", false},
+		{"time < 1d12h", true},
+		{"date = 2023-03-05", true},
+		{"date < 2023-03-05", false},
+		{"work >= 2400", true},
+		{"power < 180", false},
+		{"id = 1234", true},
+		{"gear = r3", true},
+		{"gear_id = b1", true},
+		{"commute", true},
+		{"trainer", false},
+		{"trainer = false", true},
+		{"raw.kudos_count >= 10", true},
+		{"raw.private = false", true},
+		{"raw.missing = 1", false},
+
+		// Quoting and regular expressions.
+		{"name = 'morning ride'", true},
+		{`name = "Morning Ride"`, true},
+		{`name = 'it\'s'`, false},
+		{"name =~ /^Morning/", true},
+		{"name !~ /ride$/", true},
+		{`name =~ /ride$/`, false},
+		{"raw.device_name =~ /Edge/", true},
+		{"external_id =~ '^garmin'", true},
+		{"type in (Run, Ride)", true},
+		{"type in (Run, 'Virtual Ride')", false},
+
+		// Precedence: ! binds tightest, then &&, then ||.
+		{"type = Run && dist > 1km || commute", true},
+		{"commute || type = Run && dist > 1000km", true},
+		{"(commute || type = Run) && dist > 1000km", false},
+		{"type = Run && (dist > 1km || commute)", false},
+		{"!commute || trainer", false},
+		{"!(commute && trainer)", true},
+		{"not trainer and commute", true},
+		{"type = Run or not trainer", true},
+	}
+	for _, test := range tests {
+		e, err := parseWhere(test.expr)
+		if err != nil {
+			t.Errorf("parseWhere(%q): %s", test.expr, err)
+			continue
+		}
+		if got := e.eval(whereActivity); got != test.want {
+			t.Errorf("%q = %t, want %t", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestWhereErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", "empty expression"},
+		{"colour = red", `position 1: unknown field "colour"`},
+		{"type = Ride && speed > 30", `position 16: unknown field "speed"`},
+		{"raw. = 1", `unknown field "raw."`},
+		{"dist > 100", "position 8: dist \"100\": invalid distance"},
+		{"time > soon", `time "soon": invalid duration`},
+		{"date > 2023-13-01", "invalid date"},
+		{"work > lots", "invalid number"},
+		{"commute = maybe", "expected true or false"},
+		{"dist > '100km'", "dist isn't a string"},
+		{"name < b", "name can't be compared with <"},
+		{"dist =~ /1/", "dist can't be matched with =~"},
+		{"name =~ /(/", "invalid regular expression"},
+		{"name = 'open", "position 8: unterminated '"},
+		{"(type = Ride", "expected )"},
+		{"type = Ride)", `position 12: unexpected ")"`},
+		{"type Ride", "expected an operator after type"},
+		{"type in Ride", "expected ( after in"},
+		{"type in (Ride Run)", "expected , or )"},
+		{"&& commute", "expected a field"},
+		{"commute &&", "expected a field"},
+	}
+	for _, test := range tests {
+		_, err := parseWhere(test.expr)
+		if err == nil {
+			t.Errorf("parseWhere(%q) succeeded, want an error containing %q", test.expr, test.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parseWhere(%q) = %q, want an error containing %q", test.expr, err, test.want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+	}{
+		{"0", 0},
+		{"90s", 90 * time.Second},
+		{"1h30m", 90 * time.Minute},
+		{"36h", 36 * time.Hour},
+		{"1d12h", 36 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{"2w", 14 * day},
+		{"1y6w", 365*day + 42*day},
+	}
+	for _, test := range tests {
+		got, err := parseDuration(test.s)
+		if err != nil || got != test.want {
+			t.Errorf("parseDuration(%q) = %s, %v, want %s", test.s, got, err, test.want)
+		}
+	}
+	for _, s := range []string{"", "d", "10", "-1d", "1x", "1d 2h", "1..5h"} {
+		if got, err := parseDuration(s); err == nil {
+			t.Errorf("parseDuration(%q) = %s, want an error", s, got)
+		}
+	}
+}
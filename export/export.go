@@ -0,0 +1,105 @@
+// Package export converts Strava activities and their streams to GPX and TCX
+// files.
+package export
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/markdrayton/sls/geo"
+	"github.com/markdrayton/sls/strava"
+)
+
+const timeFormat = "2006-01-02T15:04:05Z"
+
+var (
+	// ErrNoTime is returned for activities without a time stream; without
+	// one no point can be timestamped.
+	ErrNoTime = errors.New("activity has no time stream")
+	// ErrNoPosition is returned when writing GPX for an activity without
+	// GPS data, e.g. an indoor ride. TCX can represent these.
+	ErrNoPosition = errors.New("activity has no GPS data")
+)
+
+// Filename returns a file name for the activity made from its local start
+// time, ID and name, e.g. "2020-05-01-0930-3361349384-morning-ride.gpx". The
+// ID keeps activities that started in the same minute apart.
+func Filename(a strava.Activity, ext string) string {
+	name := fmt.Sprintf("%d", a.Id)
+	if t, err := time.Parse(time.RFC3339, a.StartDateLocal); err == nil {
+		name = t.Format("2006-01-02-1504") + "-" + name
+	}
+	if slug := slugify(a.Name); slug != "" {
+		name += "-" + slug
+	}
+	return name + "." + ext
+}
+
+// slugify lowercases s and replaces runs of anything other than letters and
+// digits with a single hyphen.
+func slugify(s string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+		} else {
+			hyphen = true
+		}
+	}
+	return b.String()
+}
+
+// point is one sample from an activity's streams. Fields whose stream is
+// missing are nil.
+type point struct {
+	time      time.Time
+	latLng    *geo.LatLng
+	altitude  *float64
+	distance  *float64
+	heartrate *int
+	cadence   *int
+	watts     *int
+	temp      *int
+}
+
+// points zips an activity's streams into samples.
+func points(a strava.Activity, streams strava.StreamSet) ([]point, error) {
+	if streams.Time == nil || len(streams.Time.Data) == 0 {
+		return nil, ErrNoTime
+	}
+
+	pts := make([]point, len(streams.Time.Data))
+	for i, t := range streams.Time.Data {
+		p := &pts[i]
+		p.time = a.StartDate.Add(time.Duration(t) * time.Second).UTC()
+		if streams.LatLng != nil && i < len(streams.LatLng.Data) {
+			p.latLng = &streams.LatLng.Data[i]
+		}
+		if streams.Altitude != nil && i < len(streams.Altitude.Data) {
+			p.altitude = &streams.Altitude.Data[i]
+		}
+		if streams.Distance != nil && i < len(streams.Distance.Data) {
+			p.distance = &streams.Distance.Data[i]
+		}
+		p.heartrate = intAt(streams.Heartrate, i)
+		p.cadence = intAt(streams.Cadence, i)
+		p.watts = intAt(streams.Watts, i)
+		p.temp = intAt(streams.Temp, i)
+	}
+	return pts, nil
+}
+
+func intAt(s *strava.IntStream, i int) *int {
+	if s == nil || i >= len(s.Data) {
+		return nil
+	}
+	return &s.Data[i]
+}
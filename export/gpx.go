@@ -0,0 +1,127 @@
+package export
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/markdrayton/sls/strava"
+)
+
+// GPX 1.1 (https://www.topografix.com/GPX/1/1/) with heart rate, cadence and
+// temperature in Garmin's TrackPointExtension. GPX has no standard place for
+// power, so it's left out; use TCX to keep it.
+const (
+	gpxNamespace    = "http://www.topografix.com/GPX/1/1"
+	gpxSchema       = "http://www.topografix.com/GPX/1/1/gpx.xsd"
+	gpxtpxNamespace = "http://www.garmin.com/xmlschemas/TrackPointExtension/v1"
+	gpxtpxSchema    = "https://www8.garmin.com/xmlschemas/TrackPointExtensionv1.xsd"
+	xsiNamespace    = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
+type gpx struct {
+	XMLName        xml.Name    `xml:"gpx"`
+	Xmlns          string      `xml:"xmlns,attr"`
+	XmlnsXsi       string      `xml:"xmlns:xsi,attr"`
+	XmlnsGpxtpx    string      `xml:"xmlns:gpxtpx,attr"`
+	SchemaLocation string      `xml:"xsi:schemaLocation,attr"`
+	Version        string      `xml:"version,attr"`
+	Creator        string      `xml:"creator,attr"`
+	Metadata       gpxMetadata `xml:"metadata"`
+	Track          gpxTrack    `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name string `xml:"name"`
+	Time string `xml:"time"`
+}
+
+type gpxTrack struct {
+	Name    string          `xml:"name"`
+	Type    string          `xml:"type,omitempty"`
+	Segment []gpxTrackPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxTrackPoint struct {
+	Lat        float64        `xml:"lat,attr"`
+	Lon        float64        `xml:"lon,attr"`
+	Elevation  *float64       `xml:"ele"`
+	Time       string         `xml:"time"`
+	Extensions *gpxExtensions `xml:"extensions"`
+}
+
+type gpxExtensions struct {
+	TrackPoint gpxTrackPointExtension `xml:"gpxtpx:TrackPointExtension"`
+}
+
+type gpxTrackPointExtension struct {
+	Temp      *int `xml:"gpxtpx:atemp"`
+	Heartrate *int `xml:"gpxtpx:hr"`
+	Cadence   *int `xml:"gpxtpx:cad"`
+}
+
+// GPX writes the activity as a GPX track. Samples without a position are
+// skipped; ErrNoPosition is returned if that leaves none.
+func GPX(w io.Writer, a strava.Activity, streams strava.StreamSet) error {
+	pts, err := points(a, streams)
+	if err != nil {
+		return err
+	}
+
+	trkpts := make([]gpxTrackPoint, 0, len(pts))
+	for _, p := range pts {
+		if p.latLng == nil || p.latLng.IsZero() {
+			continue
+		}
+		trkpt := gpxTrackPoint{
+			Lat:       p.latLng.Lat(),
+			Lon:       p.latLng.Lng(),
+			Elevation: p.altitude,
+			Time:      p.time.Format(timeFormat),
+		}
+		if p.heartrate != nil || p.cadence != nil || p.temp != nil {
+			trkpt.Extensions = &gpxExtensions{gpxTrackPointExtension{
+				Temp:      p.temp,
+				Heartrate: p.heartrate,
+				Cadence:   p.cadence,
+			}}
+		}
+		trkpts = append(trkpts, trkpt)
+	}
+	if len(trkpts) == 0 {
+		return ErrNoPosition
+	}
+
+	doc := gpx{
+		Xmlns:          gpxNamespace,
+		XmlnsXsi:       xsiNamespace,
+		XmlnsGpxtpx:    gpxtpxNamespace,
+		SchemaLocation: gpxNamespace + " " + gpxSchema + " " + gpxtpxNamespace + " " + gpxtpxSchema,
+		Version:        "1.1",
+		Creator:        "sls",
+		Metadata: gpxMetadata{
+			Name: a.Name,
+			Time: a.StartDate.UTC().Format(timeFormat),
+		},
+		Track: gpxTrack{
+			Name:    a.Name,
+			Type:    a.Type,
+			Segment: trkpts,
+		},
+	}
+	return encode(w, doc)
+}
+
+func encode(w io.Writer, doc interface{}) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,152 @@
+package export
+
+import (
+	"encoding/xml"
+	"io"
+	"math"
+
+	"github.com/markdrayton/sls/strava"
+)
+
+// Training Center Database v2
+// (https://www8.garmin.com/xmlschemas/TrainingCenterDatabasev2.xsd) with power
+// in Garmin's ActivityExtension.
+const (
+	tcxNamespace = "http://www.garmin.com/xmlschemas/TrainingCenterDatabase/v2"
+	tcxSchema    = "https://www8.garmin.com/xmlschemas/TrainingCenterDatabasev2.xsd"
+	axNamespace  = "http://www.garmin.com/xmlschemas/ActivityExtension/v2"
+	axSchema     = "https://www8.garmin.com/xmlschemas/ActivityExtensionv2.xsd"
+)
+
+type tcx struct {
+	XMLName        xml.Name    `xml:"TrainingCenterDatabase"`
+	Xmlns          string      `xml:"xmlns,attr"`
+	XmlnsXsi       string      `xml:"xmlns:xsi,attr"`
+	XmlnsAx        string      `xml:"xmlns:ax,attr"`
+	SchemaLocation string      `xml:"xsi:schemaLocation,attr"`
+	Activity       tcxActivity `xml:"Activities>Activity"`
+}
+
+// Element order matters in TCX; fields follow the schema's sequences.
+type tcxActivity struct {
+	Sport string `xml:"Sport,attr"`
+	Id    string `xml:"Id"`
+	Lap   tcxLap `xml:"Lap"`
+	Notes string `xml:"Notes,omitempty"`
+}
+
+type tcxLap struct {
+	StartTime        string          `xml:"StartTime,attr"`
+	TotalTimeSeconds float64         `xml:"TotalTimeSeconds"`
+	DistanceMeters   float64         `xml:"DistanceMeters"`
+	Calories         int             `xml:"Calories"`
+	Intensity        string          `xml:"Intensity"`
+	TriggerMethod    string          `xml:"TriggerMethod"`
+	Track            []tcxTrackpoint `xml:"Track>Trackpoint"`
+}
+
+type tcxTrackpoint struct {
+	Time           string         `xml:"Time"`
+	Position       *tcxPosition   `xml:"Position"`
+	AltitudeMeters *float64       `xml:"AltitudeMeters"`
+	DistanceMeters *float64       `xml:"DistanceMeters"`
+	HeartRateBpm   *tcxHeartRate  `xml:"HeartRateBpm"`
+	Cadence        *int           `xml:"Cadence"`
+	Extensions     *tcxExtensions `xml:"Extensions"`
+}
+
+type tcxPosition struct {
+	LatitudeDegrees  float64 `xml:"LatitudeDegrees"`
+	LongitudeDegrees float64 `xml:"LongitudeDegrees"`
+}
+
+type tcxHeartRate struct {
+	Value int `xml:"Value"`
+}
+
+type tcxExtensions struct {
+	TPX tcxTPX `xml:"ax:TPX"`
+}
+
+type tcxTPX struct {
+	RunCadence *int `xml:"ax:RunCadence"`
+	Watts      *int `xml:"ax:Watts"`
+}
+
+// TCX writes the activity as a single-lap TCX activity. Unlike GPX, samples
+// without a position are kept, so indoor activities can be exported too.
+func TCX(w io.Writer, a strava.Activity, streams strava.StreamSet) error {
+	pts, err := points(a, streams)
+	if err != nil {
+		return err
+	}
+
+	sport := tcxSport(a.Type)
+	trackpoints := make([]tcxTrackpoint, 0, len(pts))
+	for _, p := range pts {
+		tp := tcxTrackpoint{
+			Time:           p.time.Format(timeFormat),
+			AltitudeMeters: p.altitude,
+			DistanceMeters: p.distance,
+		}
+		if p.latLng != nil && !p.latLng.IsZero() {
+			tp.Position = &tcxPosition{p.latLng.Lat(), p.latLng.Lng()}
+		}
+		// The schema requires a heart rate of at least 1 and caps cadence
+		// at 254.
+		if p.heartrate != nil && *p.heartrate > 0 {
+			tp.HeartRateBpm = &tcxHeartRate{*p.heartrate}
+		}
+		var ext tcxTPX
+		if p.cadence != nil && *p.cadence <= 254 {
+			if sport == "Running" {
+				ext.RunCadence = p.cadence
+			} else {
+				tp.Cadence = p.cadence
+			}
+		}
+		if p.watts != nil {
+			ext.Watts = p.watts
+		}
+		if ext != (tcxTPX{}) {
+			tp.Extensions = &tcxExtensions{ext}
+		}
+		trackpoints = append(trackpoints, tp)
+	}
+
+	start := a.StartDate.UTC().Format(timeFormat)
+	doc := tcx{
+		Xmlns:          tcxNamespace,
+		XmlnsXsi:       xsiNamespace,
+		XmlnsAx:        axNamespace,
+		SchemaLocation: tcxNamespace + " " + tcxSchema + " " + axNamespace + " " + axSchema,
+		Activity: tcxActivity{
+			Sport: sport,
+			Id:    start,
+			Lap: tcxLap{
+				StartTime:        start,
+				TotalTimeSeconds: pts[len(pts)-1].time.Sub(pts[0].time).Seconds(),
+				DistanceMeters:   a.Distance,
+				// Kilojoules of work is roughly kilocalories burned.
+				Calories:      int(math.Min(math.Round(a.Kilojoules), math.MaxUint16)),
+				Intensity:     "Active",
+				TriggerMethod: "Manual",
+				Track:         trackpoints,
+			},
+			Notes: a.Name,
+		},
+	}
+	return encode(w, doc)
+}
+
+// tcxSport maps a Strava activity type to one of TCX's three sports.
+func tcxSport(activityType string) string {
+	switch activityType {
+	case "Ride", "VirtualRide", "EBikeRide", "Handcycle", "Velomobile":
+		return "Biking"
+	case "Run", "VirtualRun", "TrailRun":
+		return "Running"
+	default:
+		return "Other"
+	}
+}
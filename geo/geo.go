@@ -31,6 +31,15 @@ func RoundLatLng(l LatLng) LatLng {
 	return LatLng{flooredLat, flooredLng}
 }
 
+// Distance returns the great-circle distance between a and b in km.
+func Distance(a, b LatLng) float64 {
+	lat1, lat2 := deg2rad(a.Lat()), deg2rad(b.Lat())
+	dLat := lat2 - lat1
+	dLng := deg2rad(b.Lng() - a.Lng())
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1)*math.Cos(lat2)*math.Pow(math.Sin(dLng/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
 func deg2rad(degrees float64) float64 {
 	return degrees * (math.Pi / 180)
 }
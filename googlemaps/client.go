@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 
@@ -14,19 +15,44 @@ import (
 )
 
 const (
-	geocodeUrl = "https://maps.googleapis.com/maps/api/geocode/json?latlng=%f,%f&key=%s"
+	// DefaultBaseURL is the Google Maps host used unless WithBaseURL is given.
+	DefaultBaseURL = "https://maps.googleapis.com"
+
+	geocodeUrl = "/maps/api/geocode/json?latlng=%f,%f&key=%s"
 	// The geocoding API has a 50 QPS limit in addition to quotas. The average
 	// response time is 100ms so a parallelism of 3 should stay under the cap.
 	numWorkers = 3
 )
 
 type Client struct {
-	APIKey string
-	hc     *http.Client
+	APIKey  string
+	baseURL string
+	hc      *http.Client
+}
+
+// Option configures optional Client behaviour.
+type Option func(*Client)
+
+// WithBaseURL directs requests to baseURL instead of DefaultBaseURL.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithHTTPClient makes requests using hc instead of a default http.Client.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.hc = hc
+	}
 }
 
-func NewClient(APIKey string) *Client {
-	return &Client{APIKey, &http.Client{}}
+func NewClient(APIKey string, opts ...Option) *Client {
+	c := &Client{APIKey, DefaultBaseURL, &http.Client{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 type GoogleGeocodeResponse struct {
@@ -49,21 +75,26 @@ type GeocodeResult struct {
 	Results []GoogleGeocodeResult `json:"results"`
 }
 
-func (c *Client) GeocodePoints(points []geo.LatLng) ([]GeocodeResult, error) {
+func (c *Client) GeocodePoints(ctx context.Context, points []geo.LatLng) ([]GeocodeResult, error) {
 	results := make([]GeocodeResult, 0)
 	if c.APIKey == "" { // not configured
 		return results, nil
 	}
 
-	group, _ := errgroup.WithContext(context.Background())
+	group, ctx := errgroup.WithContext(ctx)
 
 	pointsCh := make(chan geo.LatLng)
-	go func() {
+	group.Go(func() error {
+		defer close(pointsCh)
 		for _, point := range points {
-			pointsCh <- point
+			select {
+			case pointsCh <- point:
+			case <-ctx.Done():
+				return nil
+			}
 		}
-		close(pointsCh)
-	}()
+		return nil
+	})
 
 	n := numWorkers
 	if len(points) < numWorkers {
@@ -74,42 +105,61 @@ func (c *Client) GeocodePoints(points []geo.LatLng) ([]GeocodeResult, error) {
 	for i := 0; i < n; i++ {
 		group.Go(func() error {
 			for point := range pointsCh {
-				url := fmt.Sprintf(geocodeUrl, point.Lat(), point.Lng(), c.APIKey)
-				log.Debug("fetching " + url)
-				resp, err := c.hc.Get(url)
+				result, err := c.geocode(ctx, point)
 				if err != nil {
 					return err
 				}
-
-				body, err := io.ReadAll(resp.Body)
-				resp.Body.Close()
-				if err != nil {
-					return err
+				select {
+				case resultsCh <- result:
+				case <-ctx.Done():
+					return ctx.Err()
 				}
-
-				var g GoogleGeocodeResponse
-				err = json.Unmarshal(body, &g)
-				if err != nil {
-					return err
-				}
-
-				if g.Status != "OK" && g.Status != "ZERO_RESULTS" {
-					return fmt.Errorf("got non-OK from Google Maps API: %s", g.Status)
-				}
-				// ZERO_RESULTS returns empty results array
-				resultsCh <- GeocodeResult{point, g.Results}
 			}
 			return nil
 		})
 	}
 
+	complete := make(chan struct{}) // all results received
 	go func() {
 		for result := range resultsCh {
 			results = append(results, result)
 		}
+		complete <- struct{}{}
 	}()
 
 	err := group.Wait()
 	close(resultsCh)
+	<-complete
 	return results, err
 }
+
+func (c *Client) geocode(ctx context.Context, point geo.LatLng) (GeocodeResult, error) {
+	url := c.baseURL + fmt.Sprintf(geocodeUrl, point.Lat(), point.Lng(), c.APIKey)
+	log.Debug("fetching " + url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+
+	var g GoogleGeocodeResponse
+	err = json.Unmarshal(body, &g)
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+
+	if g.Status != "OK" && g.Status != "ZERO_RESULTS" {
+		return GeocodeResult{}, fmt.Errorf("got non-OK from Google Maps API: %s", g.Status)
+	}
+	// ZERO_RESULTS returns empty results array
+	return GeocodeResult{point, g.Results}, nil
+}
@@ -0,0 +1,139 @@
+// Package googlemapstest provides an in-memory fake of the Google Maps
+// reverse geocoding API for use in tests of code built on the googlemaps
+// package.
+package googlemapstest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/markdrayton/sls/geo"
+	"github.com/markdrayton/sls/googlemaps"
+)
+
+// APIKey is the key accepted by a Server.
+const APIKey = "googlemapstest-key"
+
+type Server struct {
+	*httptest.Server
+
+	mutex    *sync.Mutex
+	results  map[geo.LatLng][]googlemaps.GoogleGeocodeResult
+	status   string
+	requests int
+}
+
+// NewServer starts a fake geocoding API. Points without a result added by
+// AddResult geocode to ZERO_RESULTS. The caller should call Close when
+// finished.
+func NewServer() *Server {
+	s := &Server{
+		mutex:   &sync.Mutex{},
+		results: make(map[geo.LatLng][]googlemaps.GoogleGeocodeResult),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// AddResult makes point geocode to a single result with the given address
+// components.
+func (s *Server) AddResult(point geo.LatLng, components ...googlemaps.GoogleAddressComponent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.results[point] = []googlemaps.GoogleGeocodeResult{{AddressComponents: components}}
+}
+
+// Component is a convenience constructor for an address component whose
+// long and short names are the same.
+func Component(name string, types ...string) googlemaps.GoogleAddressComponent {
+	return googlemaps.GoogleAddressComponent{LongName: name, ShortName: name, Types: types}
+}
+
+// SetStatus makes every request fail with status, e.g. "OVER_QUERY_LIMIT".
+// An empty status restores normal behaviour.
+func (s *Server) SetStatus(status string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+}
+
+// Requests returns the number of requests served.
+func (s *Server) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests++
+
+	if r.URL.Path != "/maps/api/geocode/json" {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	resp := googlemaps.GoogleGeocodeResponse{
+		Results: make([]googlemaps.GoogleGeocodeResult, 0),
+	}
+	point, err := parseLatLng(q.Get("latlng"))
+	switch {
+	case q.Get("key") != APIKey:
+		resp.Status = "REQUEST_DENIED"
+	case err != nil:
+		resp.Status = "INVALID_REQUEST"
+	case s.status != "":
+		resp.Status = s.status
+	default:
+		resp.Status = "ZERO_RESULTS"
+		if results, ok := s.lookup(point); ok {
+			resp.Status = "OK"
+			resp.Results = results
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// lookup finds results for point, allowing for the precision lost when the
+// client formats coordinates into the query string.
+func (s *Server) lookup(point geo.LatLng) ([]googlemaps.GoogleGeocodeResult, bool) {
+	const epsilon = 1e-6
+	for p, results := range s.results {
+		if abs(p.Lat()-point.Lat()) < epsilon && abs(p.Lng()-point.Lng()) < epsilon {
+			return results, true
+		}
+	}
+	return nil, false
+}
+
+func parseLatLng(s string) (geo.LatLng, error) {
+	var l geo.LatLng
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return l, fmt.Errorf("bad latlng %q", s)
+	}
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return l, err
+		}
+		l[i] = f
+	}
+	return l, nil
+}
+
+func abs(f float64) float64 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,61 @@
+// Package atomicfile replaces files so that a crash or a concurrent reader
+// sees either the old file or the new one, never a partial write.
+package atomicfile
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces path with data.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return Write(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// Write replaces path with what write writes. The temporary file is created
+// alongside path so the rename can't cross filesystems, and it and the
+// directory are synced before Write returns.
+func Write(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	tmpFile := f.Name()
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile, path)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Not every platform can sync a directory; the rename itself is still
+	// atomic there.
+	d.Sync()
+	return nil
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/markdrayton/sls/internal/atomicfile"
+	"github.com/markdrayton/sls/strava"
+)
+
+func (s *LogStore) Check() (Report, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := lockFile(s.lock, false)
+	if err != nil {
+		return Report{}, fmt.Errorf("couldn't lock store: %w", err)
+	}
+	defer unlockFile(s.lock)
+
+	_, report, err := s.scan()
+	return report, err
+}
+
+func (s *LogStore) Repair() (Report, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := lockFile(s.lock, true)
+	if err != nil {
+		return Report{}, fmt.Errorf("couldn't lock store: %w", err)
+	}
+	defer unlockFile(s.lock)
+
+	state, report, err := s.scan()
+	if err != nil {
+		return report, err
+	}
+
+	// File each activity under its own ID, preferring a copy that already
+	// was.
+	activities := make(map[int64]strava.Activity, len(state.activities))
+	for key, a := range state.activities {
+		if _, ok := activities[a.Id]; !ok || key == a.Id {
+			activities[a.Id] = a
+		}
+	}
+	state.activities = activities
+	state.sorted = nil
+	for key, g := range state.gear {
+		if key == "" || key != g.Id {
+			delete(state.gear, key)
+		}
+	}
+
+	data, _, err := state.encode()
+	if err != nil {
+		return report, err
+	}
+	err = atomicfile.WriteFile(s.path(), data, 0644)
+	if err != nil {
+		return report, fmt.Errorf("couldn't rewrite store: %w", err)
+	}
+	// The log has been replaced, so this reloads it.
+	return report, s.catchUp()
+}
+
+// scan reads the whole log into a new state, skipping transactions with
+// records that can't be decoded, and reports on it. Must be called with the
+// mutex and lock held.
+func (s *LogStore) scan() (*LogStore, Report, error) {
+	var report Report
+	f, err := os.Open(s.path())
+	if err != nil {
+		return nil, report, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, report, err
+	}
+	report.Size = st.Size()
+
+	state := &LogStore{}
+	state.reset()
+	r := bufio.NewReader(f)
+	var pos int64
+	pending := make([]record, 0)
+	corrupt := make([]int64, 0) // in the pending transaction
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				report.Records++
+				report.Truncated++
+			}
+			break
+		}
+		if err != nil {
+			return nil, report, err
+		}
+		offset := pos
+		pos += int64(len(line))
+		report.Records++
+
+		var rec record
+		err = json.Unmarshal(line, &rec)
+		if err == nil && !rec.Commit {
+			err = validate(rec)
+		}
+		if err != nil {
+			corrupt = append(corrupt, offset)
+			continue
+		}
+		if !rec.Commit {
+			pending = append(pending, rec)
+			continue
+		}
+		report.Transactions++
+		if len(corrupt) == 0 {
+			for _, p := range pending {
+				state.apply(p)
+			}
+		}
+		report.Corrupt = append(report.Corrupt, corrupt...)
+		pending = pending[:0]
+		corrupt = corrupt[:0]
+	}
+	report.Truncated += len(pending)
+	report.Corrupt = append(report.Corrupt, corrupt...)
+
+	state.describe(&report)
+	return state, report, nil
+}
+
+// validate checks that a record can be applied.
+func validate(r record) error {
+	scratch := &LogStore{}
+	scratch.reset()
+	return scratch.apply(r)
+}
+
+// describe fills in the parts of a report that come from the state.
+func (s *LogStore) describe(report *Report) {
+	report.Version, _ = strconv.Atoi(s.meta[metaVersion])
+	report.Activities = len(s.activities)
+	report.Gear = len(s.gear)
+	report.Locations = len(s.locations)
+
+	sorted := s.sortedActivities()
+	if len(sorted) > 0 {
+		report.First = sorted[0].StartDate
+		report.Last = sorted[len(sorted)-1].StartDate
+	}
+
+	seen := make(map[int64]bool, len(s.activities))
+	duplicates := make(map[int64]bool)
+	orphaned := make(map[string]bool)
+	for key, a := range s.activities {
+		if seen[a.Id] || key != a.Id {
+			duplicates[a.Id] = true
+		}
+		seen[a.Id] = true
+		if _, ok := s.gear[a.GearId]; a.GearId != "" && !ok {
+			orphaned[a.GearId] = true
+		}
+	}
+	for key, g := range s.gear {
+		if key == "" || key != g.Id {
+			report.InvalidGear++
+		}
+	}
+	for id := range duplicates {
+		report.Duplicates = append(report.Duplicates, id)
+	}
+	sort.Slice(report.Duplicates, func(i, j int) bool { return report.Duplicates[i] < report.Duplicates[j] })
+	for id := range orphaned {
+		report.OrphanedGear = append(report.OrphanedGear, id)
+	}
+	sort.Strings(report.OrphanedGear)
+}
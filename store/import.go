@@ -0,0 +1,87 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/markdrayton/sls/googlemaps"
+	"github.com/markdrayton/sls/strava"
+)
+
+// MetaImported is set once ImportJSON has run.
+const MetaImported = "imported_json"
+
+// ImportJSON copies the whole-file JSON caches used before the store into
+// st, unless it has done so before. Missing files and empty paths are
+// skipped. It returns whether anything was imported.
+func ImportJSON(st Store, activitiesPath, gearPath, locationsPath string) (bool, error) {
+	_, done, err := st.Meta(MetaImported)
+	if err != nil || done {
+		return false, err
+	}
+
+	var activities strava.Activities
+	foundActivities, err := readJSON(activitiesPath, &activities)
+	if err != nil {
+		return false, err
+	}
+	gear := make(map[string]strava.Gear)
+	foundGear, err := readJSON(gearPath, &gear)
+	if err != nil {
+		return false, err
+	}
+	var locations []googlemaps.GeocodeResult
+	foundLocations, err := readJSON(locationsPath, &locations)
+	if err != nil {
+		return false, err
+	}
+
+	if len(activities) > 0 {
+		err = st.PutActivities(activities...)
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(gear) > 0 {
+		gears := make([]strava.Gear, 0, len(gear))
+		for _, g := range gear {
+			if g.Id != "" {
+				gears = append(gears, g)
+			}
+		}
+		err = st.PutGear(gears...)
+		if err != nil {
+			return false, err
+		}
+	}
+	if len(locations) > 0 {
+		err = st.PutLocations(locations...)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = st.SetMeta(MetaImported, "true")
+	return foundActivities || foundGear || foundLocations, err
+}
+
+// readJSON unmarshals the file at path into v, reporting whether it exists.
+func readJSON(path string, v interface{}) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return false, fmt.Errorf("couldn't read %s: %w", path, err)
+	}
+	return true, nil
+}
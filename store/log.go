@@ -0,0 +1,610 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/sls/geo"
+	"github.com/markdrayton/sls/googlemaps"
+	"github.com/markdrayton/sls/internal/atomicfile"
+	"github.com/markdrayton/sls/strava"
+)
+
+const (
+	logName  = "store.log"
+	lockName = "lock"
+
+	kindActivity = "activity"
+	kindGear     = "gear"
+	kindLocation = "location"
+	kindMeta     = "meta"
+
+	metaVersion = "version"
+
+	// The log is compacted once it holds this many superseded records and
+	// more of them than live ones.
+	compactThreshold = 1000
+)
+
+// Version is the version of the record format written by this package.
+// Bump it when older versions mustn't write to the store, and add a
+// migration if existing records need converting. Version 2 keeps each
+// activity's raw JSON, which older versions would drop; activities stored
+// earlier gain it when they're next fetched.
+const Version = 2
+
+// migrations[v] upgrades a store from version v to v+1. Stores created
+// before versioning are version 0. Versions without a migration need no
+// conversion.
+var migrations = map[int]func(s *LogStore) error{}
+
+// record is one line of the log. A transaction is a run of records followed
+// by a commit record; records without a commit after them are ignored.
+type record struct {
+	Kind    string          `json:"kind,omitempty"`
+	Key     string          `json:"key,omitempty"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Deleted bool            `json:"deleted,omitempty"`
+	// Clear removes every record of Kind.
+	Clear  bool `json:"clear,omitempty"`
+	Commit bool `json:"commit,omitempty"`
+}
+
+// LogStore is a Store kept in a directory holding an append-only log of
+// JSON records and a lock file. The log is read into memory when the store
+// is opened and again, from where it left off, whenever another process has
+// appended to it.
+type LogStore struct {
+	dir   string
+	mutex *sync.Mutex
+	lock  *os.File
+	file  *os.File
+
+	// offset is the end of the last transaction read from file. Anything
+	// after it is an unfinished transaction, or corrupt if corrupt is set.
+	offset  int64
+	corrupt bool
+	// records counts records in the log, live or not.
+	records int
+
+	activities map[int64]strava.Activity
+	sorted     strava.Activities // nil when activities has changed
+	gear       map[string]strava.Gear
+	locations  map[geo.LatLng]googlemaps.GeocodeResult
+	meta       map[string]string
+}
+
+// Open opens the store in dir, creating it if needed.
+func Open(dir string) (*LogStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &LogStore{
+		dir:   dir,
+		mutex: &sync.Mutex{},
+		lock:  lock,
+	}
+	err = s.migrate()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate brings the store up to Version. A store written by a newer
+// version is refused rather than risk losing what that version added.
+func (s *LogStore) migrate() error {
+	value, _, err := s.Meta(metaVersion)
+	if err != nil {
+		return err
+	}
+	version := 0
+	if value != "" {
+		version, err = strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid store version %q", value)
+		}
+	}
+	if version > Version {
+		return fmt.Errorf("%w: store is version %d, this is version %d", ErrVersion, version, Version)
+	}
+	for v := version; v < Version; v++ {
+		if m := migrations[v]; m != nil {
+			err = m(s)
+			if err != nil {
+				return fmt.Errorf("couldn't migrate store from version %d: %w", v, err)
+			}
+		}
+		err = s.SetMeta(metaVersion, strconv.Itoa(v+1))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *LogStore) path() string {
+	return filepath.Join(s.dir, logName)
+}
+
+func (s *LogStore) Close() error {
+	var err error
+	if s.file != nil {
+		err = s.file.Close()
+	}
+	if closeErr := s.lock.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *LogStore) Activity(id int64) (a strava.Activity, ok bool, err error) {
+	err = s.view(func() error {
+		a, ok = s.activities[id]
+		return nil
+	})
+	return a, ok, err
+}
+
+func (s *LogStore) Activities() (activities strava.Activities, err error) {
+	err = s.view(func() error {
+		activities = append(strava.Activities{}, s.sortedActivities()...)
+		return nil
+	})
+	return activities, err
+}
+
+func (s *LogStore) ActivitiesBetween(after, before time.Time) (activities strava.Activities, err error) {
+	err = s.view(func() error {
+		sorted := s.sortedActivities()
+		i := sort.Search(len(sorted), func(i int) bool { return !sorted[i].StartDate.Before(after) })
+		j := sort.Search(len(sorted), func(j int) bool { return !sorted[j].StartDate.Before(before) })
+		if i < j {
+			activities = append(strava.Activities{}, sorted[i:j]...)
+		}
+		return nil
+	})
+	return activities, err
+}
+
+func (s *LogStore) PutActivities(activities ...strava.Activity) error {
+	records := make([]record, 0, len(activities))
+	for _, a := range activities {
+		r, err := putRecord(kindActivity, strconv.FormatInt(a.Id, 10), a)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+	}
+	return s.write(records)
+}
+
+func (s *LogStore) DeleteActivities(ids ...int64) error {
+	records := make([]record, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, record{Kind: kindActivity, Key: strconv.FormatInt(id, 10), Deleted: true})
+	}
+	return s.write(records)
+}
+
+func (s *LogStore) ReplaceActivities(activities strava.Activities) error {
+	records := make([]record, 0, len(activities)+1)
+	records = append(records, record{Kind: kindActivity, Clear: true})
+	for _, a := range activities {
+		r, err := putRecord(kindActivity, strconv.FormatInt(a.Id, 10), a)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+	}
+	return s.write(records)
+}
+
+func (s *LogStore) Gear() (gear map[string]strava.Gear, err error) {
+	err = s.view(func() error {
+		gear = make(map[string]strava.Gear, len(s.gear))
+		for id, g := range s.gear {
+			gear[id] = g
+		}
+		return nil
+	})
+	return gear, err
+}
+
+func (s *LogStore) PutGear(gear ...strava.Gear) error {
+	records := make([]record, 0, len(gear))
+	for _, g := range gear {
+		r, err := putRecord(kindGear, g.Id, g)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+	}
+	return s.write(records)
+}
+
+func (s *LogStore) Locations() (locations map[geo.LatLng]googlemaps.GeocodeResult, err error) {
+	err = s.view(func() error {
+		locations = make(map[geo.LatLng]googlemaps.GeocodeResult, len(s.locations))
+		for latLng, l := range s.locations {
+			locations[latLng] = l
+		}
+		return nil
+	})
+	return locations, err
+}
+
+func (s *LogStore) PutLocations(locations ...googlemaps.GeocodeResult) error {
+	records := make([]record, 0, len(locations))
+	for _, l := range locations {
+		r, err := putRecord(kindLocation, locationKey(l.LatLng), l)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+	}
+	return s.write(records)
+}
+
+func (s *LogStore) Meta(key string) (value string, ok bool, err error) {
+	err = s.view(func() error {
+		value, ok = s.meta[key]
+		return nil
+	})
+	return value, ok, err
+}
+
+func (s *LogStore) SetMeta(key, value string) error {
+	r, err := putRecord(kindMeta, key, value)
+	if err != nil {
+		return err
+	}
+	return s.write([]record{r})
+}
+
+func putRecord(kind, key string, v interface{}) (record, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return record{}, fmt.Errorf("couldn't marshal %s %s: %w", kind, key, err)
+	}
+	return record{Kind: kind, Key: key, Value: data}, nil
+}
+
+func locationKey(l geo.LatLng) string {
+	return strconv.FormatFloat(l.Lat(), 'g', -1, 64) + "," + strconv.FormatFloat(l.Lng(), 'g', -1, 64)
+}
+
+// sortedActivities returns the activities ordered by start date. Must be
+// called with the mutex held; the result mustn't be modified.
+func (s *LogStore) sortedActivities() strava.Activities {
+	if s.sorted == nil {
+		s.sorted = make(strava.Activities, 0, len(s.activities))
+		for _, a := range s.activities {
+			s.sorted = append(s.sorted, a)
+		}
+		sort.Slice(s.sorted, func(i, j int) bool {
+			a, b := s.sorted[i], s.sorted[j]
+			if a.StartDate.Equal(b.StartDate) {
+				return a.Id < b.Id
+			}
+			return a.StartDate.Before(b.StartDate)
+		})
+	}
+	return s.sorted
+}
+
+// view runs fn with a shared lock held and the in-memory state up to date.
+func (s *LogStore) view(fn func() error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := lockFile(s.lock, false)
+	if err != nil {
+		return fmt.Errorf("couldn't lock store: %w", err)
+	}
+	defer unlockFile(s.lock)
+
+	err = s.catchUp()
+	if err != nil {
+		return err
+	}
+	return fn()
+}
+
+// write appends records to the log as one transaction and applies them.
+func (s *LogStore) write(records []record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := lockFile(s.lock, true)
+	if err != nil {
+		return fmt.Errorf("couldn't lock store: %w", err)
+	}
+	defer unlockFile(s.lock)
+
+	err = s.catchUp()
+	if err != nil {
+		return err
+	}
+	if s.corrupt {
+		return fmt.Errorf("%w: unreadable record in %s after offset %d", ErrCorrupt, s.path(), s.offset)
+	}
+	// Drop any transaction a crashed writer didn't finish.
+	err = s.file.Truncate(s.offset)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range append(records, record{Commit: true}) {
+		err = enc.Encode(r)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.file.Write(buf.Bytes())
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.file.Truncate(s.offset)
+		return fmt.Errorf("couldn't write to store: %w", err)
+	}
+	s.offset += int64(buf.Len())
+
+	for _, r := range records {
+		err = s.apply(r)
+		if err != nil {
+			return err
+		}
+	}
+	s.records += len(records) + 1
+	return s.maybeCompact()
+}
+
+// catchUp reads transactions appended to the log since it was last read,
+// reopening the log if another process has compacted it. Must be called
+// with the mutex and lock held.
+func (s *LogStore) catchUp() error {
+	st, err := os.Stat(s.path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if s.file == nil || st == nil || !sameFile(s.file, st) {
+		err = s.reopen()
+		if err != nil {
+			return err
+		}
+		st, err = s.file.Stat()
+		if err != nil {
+			return err
+		}
+	}
+	if st.Size() <= s.offset {
+		return nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(s.file, s.offset, st.Size()-s.offset))
+	pos := s.offset
+	pending := make([]record, 0)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// An incomplete line: a transaction still being written or cut
+			// short by a crash.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pos += int64(len(line))
+
+		var rec record
+		err = json.Unmarshal(line, &rec)
+		if err != nil {
+			s.corrupt = true
+			return nil
+		}
+		if !rec.Commit {
+			pending = append(pending, rec)
+			continue
+		}
+		// Check the whole transaction first so that a bad record can't
+		// leave it half applied.
+		for _, p := range pending {
+			if validate(p) != nil {
+				s.corrupt = true
+				return nil
+			}
+		}
+		for _, p := range pending {
+			err = s.apply(p)
+			if err != nil {
+				return err
+			}
+		}
+		s.records += len(pending) + 1
+		s.offset = pos
+		pending = pending[:0]
+	}
+}
+
+// reopen opens the log afresh, creating it if needed, and forgets
+// everything read from the old one.
+func (s *LogStore) reopen() error {
+	if s.file != nil {
+		s.file.Close()
+	}
+	f, err := os.OpenFile(s.path(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.offset = 0
+	s.corrupt = false
+	s.records = 0
+	s.reset()
+	return nil
+}
+
+// reset empties the in-memory state.
+func (s *LogStore) reset() {
+	s.activities = make(map[int64]strava.Activity)
+	s.sorted = nil
+	s.gear = make(map[string]strava.Gear)
+	s.locations = make(map[geo.LatLng]googlemaps.GeocodeResult)
+	s.meta = make(map[string]string)
+}
+
+func sameFile(f *os.File, st os.FileInfo) bool {
+	fst, err := f.Stat()
+	return err == nil && os.SameFile(fst, st)
+}
+
+// apply applies a record to the in-memory state. A record that can't be
+// decoded changes nothing.
+func (s *LogStore) apply(r record) error {
+	switch r.Kind {
+	case kindActivity:
+		if r.Clear {
+			s.activities = make(map[int64]strava.Activity)
+			s.sorted = nil
+			return nil
+		}
+		id, err := strconv.ParseInt(r.Key, 10, 64)
+		if err != nil {
+			return err
+		}
+		if r.Deleted {
+			delete(s.activities, id)
+			s.sorted = nil
+			return nil
+		}
+		var a strava.Activity
+		err = json.Unmarshal(r.Value, &a)
+		if err != nil {
+			return err
+		}
+		s.activities[id] = a
+		s.sorted = nil
+	case kindGear:
+		if r.Deleted {
+			delete(s.gear, r.Key)
+			return nil
+		}
+		var g strava.Gear
+		err := json.Unmarshal(r.Value, &g)
+		if err != nil {
+			return err
+		}
+		s.gear[r.Key] = g
+	case kindLocation:
+		var l googlemaps.GeocodeResult
+		err := json.Unmarshal(r.Value, &l)
+		if err != nil {
+			return err
+		}
+		s.locations[l.LatLng] = l
+	case kindMeta:
+		var v string
+		err := json.Unmarshal(r.Value, &v)
+		if err != nil {
+			return err
+		}
+		s.meta[r.Key] = v
+	default:
+		return fmt.Errorf("unknown record kind %q", r.Kind)
+	}
+	return nil
+}
+
+// maybeCompact rewrites the log without superseded records once they
+// dominate it. Must be called with the mutex and exclusive lock held.
+func (s *LogStore) maybeCompact() error {
+	live := len(s.activities) + len(s.gear) + len(s.locations) + len(s.meta)
+	dead := s.records - live
+	if dead < compactThreshold || dead < live {
+		return nil
+	}
+	return s.compact()
+}
+
+func (s *LogStore) compact() error {
+	data, records, err := s.encode()
+	if err != nil {
+		return err
+	}
+	err = atomicfile.WriteFile(s.path(), data, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't compact store: %w", err)
+	}
+
+	// Everything is already in memory; just switch to the new file.
+	f, err := os.OpenFile(s.path(), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = f
+	s.offset = int64(len(data))
+	s.records = records
+	return nil
+}
+
+// encode returns the in-memory state as a log holding a single transaction,
+// and the number of records in it.
+func (s *LogStore) encode() ([]byte, int, error) {
+	records := make([]record, 0)
+	add := func(kind, key string, v interface{}) error {
+		r, err := putRecord(kind, key, v)
+		records = append(records, r)
+		return err
+	}
+	for k, v := range s.meta {
+		if err := add(kindMeta, k, v); err != nil {
+			return nil, 0, err
+		}
+	}
+	for id, g := range s.gear {
+		if err := add(kindGear, id, g); err != nil {
+			return nil, 0, err
+		}
+	}
+	for latLng, l := range s.locations {
+		if err := add(kindLocation, locationKey(latLng), l); err != nil {
+			return nil, 0, err
+		}
+	}
+	for _, a := range s.sortedActivities() {
+		if err := add(kindActivity, strconv.FormatInt(a.Id, 10), a); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range append(records, record{Commit: true}) {
+		err := enc.Encode(r)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return buf.Bytes(), len(records) + 1, nil
+}
@@ -0,0 +1,237 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/markdrayton/sls/strava"
+)
+
+func openStore(t *testing.T, dir string) *LogStore {
+	t.Helper()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func activity(id int64) strava.Activity {
+	start := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	return strava.Activity{Id: id, Name: "Ride", StartDate: start.Add(time.Duration(id) * time.Hour)}
+}
+
+func ids(t *testing.T, s *LogStore) []int64 {
+	t.Helper()
+	activities, err := s.Activities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, 0, len(activities))
+	for _, a := range activities {
+		ids = append(ids, a.Id)
+	}
+	return ids
+}
+
+func sameIds(got, want []int64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// appendLog appends raw text to the log, as a crashed writer might.
+func appendLog(t *testing.T, dir, text string) {
+	t.Helper()
+	f, err := os.OpenFile(filepath.Join(dir, logName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	_, err = f.WriteString(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func activityRecord(t *testing.T, a strava.Activity) string {
+	t.Helper()
+	r, err := putRecord(kindActivity, strconv.FormatInt(a.Id, 10), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(line) + "\n"
+}
+
+func TestUncommittedTransactionIgnored(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir)
+	err := s.PutActivities(activity(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	appendLog(t, dir, activityRecord(t, activity(2)))
+
+	s = openStore(t, dir)
+	defer s.Close()
+	if got := ids(t, s); !sameIds(got, []int64{1}) {
+		t.Fatalf("activities %v, want [1]", got)
+	}
+	// The next write replaces the unfinished transaction rather than
+	// committing it.
+	err = s.PutActivities(activity(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := openStore(t, dir)
+	defer other.Close()
+	if got := ids(t, other); !sameIds(got, []int64{1, 3}) {
+		t.Errorf("activities %v, want [1 3]", got)
+	}
+}
+
+func TestCompactionSeenByOtherHandle(t *testing.T) {
+	dir := t.TempDir()
+	first := openStore(t, dir)
+	defer first.Close()
+	second := openStore(t, dir)
+	defer second.Close()
+
+	batch := make([]strava.Activity, 0, compactThreshold/2)
+	for i := 0; i < cap(batch); i++ {
+		batch = append(batch, activity(int64(i+1)))
+	}
+	if got := ids(t, second); len(got) != 0 {
+		t.Fatalf("new store has activities %v", got)
+	}
+	// Rewriting the same activities leaves more and more superseded
+	// records until the log is compacted.
+	for i := 0; i < 3; i++ {
+		err := first.PutActivities(batch...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if first.records > len(batch)+2 {
+		t.Fatalf("log has %d records after compaction, want at most %d", first.records, len(batch)+2)
+	}
+
+	err := first.PutActivities(activity(9999))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ids(t, second)
+	if len(got) != len(batch)+1 || got[len(got)-1] != 9999 {
+		t.Errorf("second handle has %d activities, want %d ending with 9999", len(got), len(batch)+1)
+	}
+}
+
+func TestRepairTornTail(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir)
+	defer s.Close()
+	err := s.PutActivities(activity(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := activityRecord(t, activity(2))
+	appendLog(t, dir, record+record[:len(record)/2])
+
+	report, err := s.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Truncated != 2 || report.OK() {
+		t.Fatalf("Check reported %d truncated records, OK %t; want 2, false", report.Truncated, report.OK())
+	}
+	report, err = s.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Truncated != 2 {
+		t.Errorf("Repair reported %d truncated records, want 2", report.Truncated)
+	}
+
+	report, err = s.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.OK() || report.Truncated != 0 {
+		t.Errorf("after Repair, Check reported %+v", report)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, logName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[len(data)-1] != '\n' {
+		t.Error("log still ends with a partial record")
+	}
+	if got := ids(t, s); !sameIds(got, []int64{1}) {
+		t.Errorf("activities %v, want [1]", got)
+	}
+}
+
+func TestImportJSONOnce(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, filepath.Join(dir, "store"))
+	defer s.Close()
+
+	activitiesPath := filepath.Join(dir, "activities.json")
+	gearPath := filepath.Join(dir, "gear.json")
+	writeJSON := func(path string, v interface{}) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeJSON(activitiesPath, strava.Activities{activity(1), activity(2)})
+	// Older versions could store gear without its ID.
+	writeJSON(gearPath, map[string]strava.Gear{"b1": {Id: "b1", Name: "R3"}, "": {}})
+
+	imported, err := ImportJSON(s, activitiesPath, gearPath, filepath.Join(dir, "locations.json"))
+	if err != nil || !imported {
+		t.Fatalf("ImportJSON = %t, %v, want true, nil", imported, err)
+	}
+	if got := ids(t, s); !sameIds(got, []int64{1, 2}) {
+		t.Errorf("activities %v, want [1 2]", got)
+	}
+	gear, err := s.Gear()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gear) != 1 || gear["b1"].Name != "R3" {
+		t.Errorf("gear %v, want only R3", gear)
+	}
+
+	err = s.DeleteActivities(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported, err = ImportJSON(s, activitiesPath, gearPath, "")
+	if err != nil || imported {
+		t.Fatalf("second ImportJSON = %t, %v, want false, nil", imported, err)
+	}
+	if got := ids(t, s); !sameIds(got, []int64{1}) {
+		t.Errorf("activities after a second import %v, want [1]", got)
+	}
+}
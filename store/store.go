@@ -0,0 +1,101 @@
+// Package store keeps the activities, gear and geocoded start locations
+// fetched by sls.
+//
+// Store is implemented by LogStore, an append-only log on disk indexed in
+// memory. Each write is a transaction appended to the log, so the cost of a
+// run grows with what changed rather than with the size of the history, and
+// a file lock lets several processes share one store.
+package store
+
+import (
+	"errors"
+	"time"
+
+	"github.com/markdrayton/sls/geo"
+	"github.com/markdrayton/sls/googlemaps"
+	"github.com/markdrayton/sls/strava"
+)
+
+var (
+	// ErrCorrupt is returned by writes to a store that has been damaged, as
+	// they could otherwise lose the data after the damage. Repair fixes it.
+	ErrCorrupt = errors.New("store is corrupt")
+	// ErrVersion is returned when opening a store written by a newer
+	// version of this package.
+	ErrVersion = errors.New("store was written by a newer version of sls")
+)
+
+type Store interface {
+	// Activity looks up an activity by ID.
+	Activity(id int64) (strava.Activity, bool, error)
+	// Activities returns every activity, oldest first.
+	Activities() (strava.Activities, error)
+	// ActivitiesBetween returns the activities that started in [after,
+	// before), oldest first.
+	ActivitiesBetween(after, before time.Time) (strava.Activities, error)
+	// PutActivities inserts activities or replaces those with the same IDs.
+	PutActivities(activities ...strava.Activity) error
+	// DeleteActivities removes activities. Unknown IDs are ignored.
+	DeleteActivities(ids ...int64) error
+	// ReplaceActivities replaces every activity with activities.
+	ReplaceActivities(activities strava.Activities) error
+
+	// Gear returns all gear by ID.
+	Gear() (map[string]strava.Gear, error)
+	// PutGear inserts gear or replaces gear with the same IDs.
+	PutGear(gear ...strava.Gear) error
+
+	// Locations returns all geocoded locations by rounded start position.
+	Locations() (map[geo.LatLng]googlemaps.GeocodeResult, error)
+	// PutLocations inserts locations or replaces those at the same
+	// positions.
+	PutLocations(locations ...googlemaps.GeocodeResult) error
+
+	// Meta and SetMeta get and set free-form values describing the store
+	// itself.
+	Meta(key string) (string, bool, error)
+	SetMeta(key, value string) error
+
+	// Check examines the store for damage and inconsistencies without
+	// changing it.
+	Check() (Report, error)
+	// Repair rewrites the store without the problems Check finds, keeping
+	// everything that can be read. Orphaned gear is reported but left for
+	// the caller to fetch.
+	Repair() (Report, error)
+
+	Close() error
+}
+
+// Report describes the state of a store and any problems with it.
+type Report struct {
+	Version      int
+	Size         int64 // bytes on disk
+	Records      int   // including superseded records
+	Transactions int
+	Activities   int
+	Gear         int
+	Locations    int
+	// First and Last are the start dates of the oldest and newest activities.
+	First, Last time.Time
+
+	// Corrupt holds the offsets of records that can't be decoded. The
+	// transactions containing them are ignored.
+	Corrupt []int64
+	// Truncated counts records after the last commit, left by an
+	// interrupted write.
+	Truncated int
+	// Duplicates holds IDs of activities stored more than once, or under
+	// another activity's ID.
+	Duplicates []int64
+	// InvalidGear counts gear stored without its ID.
+	InvalidGear int
+	// OrphanedGear holds gear IDs used by activities but not stored.
+	OrphanedGear []string
+}
+
+// OK reports whether the report found no problems.
+func (r Report) OK() bool {
+	return len(r.Corrupt) == 0 && r.Truncated == 0 && len(r.Duplicates) == 0 &&
+		r.InvalidGear == 0 && len(r.OrphanedGear) == 0
+}
@@ -0,0 +1,120 @@
+package strava
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/markdrayton/sls/internal/atomicfile"
+)
+
+// Checkpoints older than this are discarded rather than resumed, as the
+// activities they hold may since have been edited or deleted.
+const maxCheckpointAge = 24 * time.Hour
+
+// checkpoint holds the raw pages of a partially completed activity listing.
+// A nil checkpoint is valid and stores nothing.
+type checkpoint struct {
+	dir string
+}
+
+// checkpointMeta identifies the listing a checkpoint belongs to.
+type checkpointMeta struct {
+	AthleteId int64     `json:"athlete_id"`
+	After     int64     `json:"after"`
+	PerPage   int       `json:"per_page"`
+	Created   time.Time `json:"created"`
+}
+
+// openCheckpoint returns the checkpoint for the listing of athleteId's
+// activities after epoch, discarding any checkpoint left by a different
+// listing.
+func (c *Client) openCheckpoint(athleteId int64, epoch time.Time) (*checkpoint, error) {
+	if c.checkpointDir == "" {
+		return nil, nil
+	}
+	cp := &checkpoint{c.checkpointDir}
+	want := checkpointMeta{
+		AthleteId: athleteId,
+		After:     epoch.Unix(),
+		PerPage:   perPage,
+	}
+
+	var have checkpointMeta
+	data, err := ioutil.ReadFile(cp.metaPath())
+	if err == nil {
+		err = json.Unmarshal(data, &have)
+	}
+	if err == nil {
+		want.Created = have.Created
+		if have == want && time.Since(have.Created) < maxCheckpointAge {
+			log.Debugf("resuming activity listing from checkpoint in %s", cp.dir)
+			return cp, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("discarding unreadable checkpoint in %s: %s", cp.dir, err)
+	}
+
+	cp.remove()
+	err = os.MkdirAll(cp.dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create checkpoint directory: %w", err)
+	}
+	want.Created = time.Now()
+	data, err = json.Marshal(want)
+	if err != nil {
+		return nil, err
+	}
+	err = atomicfile.WriteFile(cp.metaPath(), data, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't write checkpoint: %w", err)
+	}
+	return cp, nil
+}
+
+func (cp *checkpoint) metaPath() string {
+	return filepath.Join(cp.dir, "meta.json")
+}
+
+func (cp *checkpoint) pagePath(page int) string {
+	return filepath.Join(cp.dir, fmt.Sprintf("page-%05d.json", page))
+}
+
+func (cp *checkpoint) load(page int) ([]byte, bool) {
+	if cp == nil {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(cp.pagePath(page))
+	if err != nil || !json.Valid(data) {
+		return nil, false
+	}
+	return data, true
+}
+
+// save records a fetched page. Failing to save only costs a refetch, so
+// errors are logged rather than returned.
+func (cp *checkpoint) save(page int, data []byte) {
+	if cp == nil {
+		return
+	}
+	err := atomicfile.WriteFile(cp.pagePath(page), data, 0600)
+	if err != nil {
+		log.Warnf("couldn't checkpoint page %d: %s", page, err)
+	}
+}
+
+func (cp *checkpoint) remove() {
+	if cp == nil {
+		return
+	}
+	err := os.RemoveAll(cp.dir)
+	if err != nil {
+		log.Warnf("couldn't remove checkpoint in %s: %s", cp.dir, err)
+	}
+}
@@ -1,12 +1,17 @@
 package strava
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,67 +19,143 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-const urlActivities = "https://www.strava.com/api/v3/athletes/%d/activities?after=%d&page=%d&per_page=%d"
-const urlGear = "https://www.strava.com/api/v3/gear/%s"
+// DefaultBaseURL is the Strava host used unless WithBaseURL is given.
+const DefaultBaseURL = "https://www.strava.com"
+
+const urlActivities = "/api/v3/athletes/%d/activities?after=%d&page=%d&per_page=%d"
+const urlActivitiesBetween = "/api/v3/athletes/%d/activities?after=%d&before=%d&page=%d&per_page=%d"
+const urlActivity = "/api/v3/activities/%d"
+const urlStreams = "/api/v3/activities/%d/streams?keys=%s&key_by_type=true"
+const urlGear = "/api/v3/gear/%s"
+const urlAthlete = "/api/v3/athlete"
 
 type Client struct {
-	creds *Credentials
-	hc    *http.Client
+	baseURL       string
+	creds         *Credentials
+	hc            *http.Client
+	limiter       *rateLimiter
+	checkpointDir string
+}
+
+// Option configures optional Client behaviour.
+type Option func(*Client)
+
+// WithBaseURL directs all requests, including token refreshes, to baseURL
+// instead of DefaultBaseURL.
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = strings.TrimSuffix(baseURL, "/")
+		c.creds.baseURL = c.baseURL
+	}
+}
+
+// WithHTTPClient makes requests using hc instead of a default http.Client.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) {
+		c.hc = hc
+		c.creds.hc = hc
+	}
+}
+
+// WithCheckpointDir saves each page fetched by Activities to dir until the
+// whole listing has been fetched, so that a failed or interrupted fetch
+// resumes from the missing pages on the next call.
+func WithCheckpointDir(dir string) Option {
+	return func(c *Client) {
+		c.checkpointDir = dir
+	}
+}
+
+// WithRateLimitState persists rate limit usage to path so that it is shared
+// between runs.
+func WithRateLimitState(path string) Option {
+	return func(c *Client) {
+		c.limiter = newRateLimiter(path)
+	}
 }
 
 const (
 	perPage    = 100
 	numWorkers = 10
+
+	// Transient failures are retried up to maxAttempts times in total.
+	maxAttempts    = 5
+	initialBackoff = time.Second
 )
 
-func NewClient(clientId int, clientSecret, tokenPath string) *Client {
+func NewClient(clientId int, clientSecret, tokenPath string, opts ...Option) *Client {
 	hc := &http.Client{}
-	return &Client{
-		NewCredentials(clientId, clientSecret, tokenPath, hc),
-		hc,
+	c := &Client{
+		baseURL: DefaultBaseURL,
+		creds:   NewCredentials(clientId, clientSecret, tokenPath, hc),
+		hc:      hc,
+		limiter: newRateLimiter(""),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
-func (c *Client) Activities(athleteId int64, epoch time.Time) (Activities, error) {
-	group, ctx := errgroup.WithContext(context.Background())
+// Credentials returns the credentials used to authenticate requests.
+func (c *Client) Credentials() *Credentials {
+	return c.creds
+}
+
+func (c *Client) Activities(ctx context.Context, athleteId int64, epoch time.Time) (Activities, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	group, ctx := errgroup.WithContext(ctx)
 	activities := make(Activities, 0)
 
-	urls := make(chan string)
-	stop := make(chan struct{}) // stop yielding page URLs
+	cp, err := c.openCheckpoint(athleteId, epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := make(chan int)
+	stop := make(chan struct{}) // stop yielding page numbers
+	var stopOnce sync.Once
 	group.Go(func() error {
-		page := 1
-		stopped := false
-		for !stopped {
-			url := fmt.Sprintf(urlActivities, athleteId, epoch.Unix(), page, perPage)
+		defer close(pages)
+		for page := 1; ; page++ {
+			// Check for a stop before offering the next page: if both cases
+			// of the select below are ready one is chosen at random.
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
 			select {
-			case urls <- url:
+			case pages <- page:
 			case <-stop:
-				stopped = true
+				return nil
+			case <-ctx.Done():
+				return nil
 			}
-			page++
 		}
-		close(urls)
-		return nil
 	})
 
 	responses := make(chan []byte)
 	complete := make(chan struct{}) // all activities received
+	var decodeErr error
 	go func() {
 		for response := range responses {
 			var page Activities
-			err := unmarshal(response, &page)
+			err := json.Unmarshal(response, &page)
 			if err != nil {
-				log.Fatalf("couldn't unmarshal gear: %s", err) // TODO avoid fatal?
+				// Abandon the fetch. Keep draining responses so workers
+				// don't block before noticing the cancellation.
+				if decodeErr == nil {
+					decodeErr = fmt.Errorf("couldn't unmarshal activities: %w", err)
+					cancel()
+				}
+				continue
 			}
 			if len(page) < perPage {
 				// Reading a short page signifies the end of the activity set has
-				// been reached, so tell the producer to stop yielding URLs. Use a
-				// nonblocking send because the producer goroutine exits once told
-				// to stop.
-				select {
-				case stop <- struct{}{}:
-				default:
-				}
+				// been reached, so tell the producer to stop yielding pages.
+				stopOnce.Do(func() { close(stop) })
 			}
 			activities = append(activities, page...)
 		}
@@ -89,38 +170,214 @@ func (c *Client) Activities(athleteId int64, epoch time.Time) (Activities, error
 	}
 
 	for i := 0; i < n; i++ {
-		group.Go(c.worker(ctx, urls, responses))
+		group.Go(func() error {
+			for page := range pages {
+				data, err := c.activityPage(ctx, cp, athleteId, epoch, page)
+				if err != nil {
+					return err
+				}
+				select {
+				case responses <- data:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
 	}
 
-	err := group.Wait()
+	err = group.Wait()
 	close(responses)
 	<-complete
+	if decodeErr != nil {
+		err = decodeErr
+	}
+	if err == nil {
+		cp.remove()
+	}
 	return activities, err
 }
 
-func (c *Client) Gears(gearIds []string) ([]Gear, error) {
-	group, ctx := errgroup.WithContext(context.Background())
-	// TODO use ctx
-	gears := make([]Gear, len(gearIds))
+// ActivitiesBetween returns the activities that started between after and
+// before. Pages are fetched serially; this is intended for revisiting a
+// recent window of activities rather than fetching the whole history.
+func (c *Client) ActivitiesBetween(ctx context.Context, athleteId int64, after, before time.Time) (Activities, error) {
+	activities := make(Activities, 0)
+	for page := 1; ; page++ {
+		u, err := url.Parse(c.baseURL + fmt.Sprintf(urlActivitiesBetween, athleteId, after.Unix(), before.Unix(), page, perPage))
+		if err != nil {
+			return nil, err
+		}
+		log.Debug("fetching " + u.String())
+		data, err := c.fetchUrlRetry(ctx, u)
+		if err != nil {
+			return activities, err
+		}
+
+		var p Activities
+		err = json.Unmarshal(data, &p)
+		if err != nil {
+			return activities, fmt.Errorf("couldn't unmarshal activities: %w", err)
+		}
+		activities = append(activities, p...)
+		if len(p) < perPage {
+			return activities, nil
+		}
+	}
+}
+
+// Activity returns the full representation of a single activity.
+func (c *Client) Activity(ctx context.Context, id int64) (DetailedActivity, error) {
+	var activity DetailedActivity
+	u, err := url.Parse(c.baseURL + fmt.Sprintf(urlActivity, id))
+	if err != nil {
+		return activity, err
+	}
+	log.Debug("fetching " + u.String())
+	data, err := c.fetchUrlRetry(ctx, u)
+	if err != nil {
+		return activity, err
+	}
+	err = json.Unmarshal(data, &activity)
+	if err != nil {
+		return activity, fmt.Errorf("couldn't unmarshal activity: %w", err)
+	}
+	return activity, nil
+}
+
+// UpdateActivity changes the activity's non-nil fields and returns the
+// updated activity. Requires the activity:write scope.
+func (c *Client) UpdateActivity(ctx context.Context, id int64, update UpdatableActivity) (DetailedActivity, error) {
+	var activity DetailedActivity
+	u, err := url.Parse(c.baseURL + fmt.Sprintf(urlActivity, id))
+	if err != nil {
+		return activity, err
+	}
+	body, err := json.Marshal(update)
+	if err != nil {
+		return activity, err
+	}
+	log.Debugf("updating %s: %s", u, body)
+	data, err := c.requestRetry(ctx, "PUT", u, "application/json", body)
+	if err != nil {
+		return activity, err
+	}
+	err = json.Unmarshal(data, &activity)
+	if err != nil {
+		return activity, fmt.Errorf("couldn't unmarshal activity: %w", err)
+	}
+	return activity, nil
+}
+
+// Streams returns an activity's raw sensor data. keys selects which streams
+// to fetch; all are fetched if none are given. Activities without any
+// streams, such as manually entered ones, result in an error matching
+// ErrNotFound.
+func (c *Client) Streams(ctx context.Context, id int64, keys ...string) (StreamSet, error) {
+	var streams StreamSet
+	if len(keys) == 0 {
+		keys = AllStreams
+	}
+	u, err := url.Parse(c.baseURL + fmt.Sprintf(urlStreams, id, url.QueryEscape(strings.Join(keys, ","))))
+	if err != nil {
+		return streams, err
+	}
+	log.Debug("fetching " + u.String())
+	data, err := c.fetchUrlRetry(ctx, u)
+	if err != nil {
+		return streams, err
+	}
+	err = json.Unmarshal(data, &streams)
+	if err != nil {
+		return streams, fmt.Errorf("couldn't unmarshal streams: %w", err)
+	}
+	return streams, nil
+}
+
+// activityPage returns a page of activities from the checkpoint if it was
+// fetched by an earlier, unsuccessful, call to Activities. Otherwise the page
+// is fetched and added to the checkpoint.
+func (c *Client) activityPage(ctx context.Context, cp *checkpoint, athleteId int64, epoch time.Time, page int) ([]byte, error) {
+	data, ok := cp.load(page)
+	if ok {
+		log.Debugf("using checkpointed page %d", page)
+		return data, nil
+	}
+
+	u, err := url.Parse(c.baseURL + fmt.Sprintf(urlActivities, athleteId, epoch.Unix(), page, perPage))
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("fetching " + u.String())
+	data, err = c.fetchUrlRetry(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+
+	if json.Valid(data) {
+		cp.save(page, data)
+	}
+	return data, nil
+}
+
+// AthleteGear returns the authenticated athlete's bikes and shoes, including
+// gear no activity uses yet. Only the summary fields are set: ID, name,
+// primary, retired and distance.
+func (c *Client) AthleteGear(ctx context.Context) ([]Gear, error) {
+	u, err := url.Parse(c.baseURL + urlAthlete)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("fetching " + u.String())
+	data, err := c.fetchUrlRetry(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	var athlete struct {
+		Bikes []Gear `json:"bikes"`
+		Shoes []Gear `json:"shoes"`
+	}
+	err = json.Unmarshal(data, &athlete)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal athlete: %w", err)
+	}
+	return append(athlete.Bikes, athlete.Shoes...), nil
+}
+
+func (c *Client) Gears(ctx context.Context, gearIds []string) ([]Gear, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	group, ctx := errgroup.WithContext(ctx)
+	gears := make([]Gear, 0, len(gearIds))
 
 	urls := make(chan string)
 	group.Go(func() error {
+		defer close(urls)
 		for _, gearId := range gearIds {
-			urls <- fmt.Sprintf(urlGear, gearId)
+			select {
+			case urls <- c.baseURL + fmt.Sprintf(urlGear, gearId):
+			case <-ctx.Done():
+				return nil
+			}
 		}
-		close(urls)
 		return nil
 	})
 
 	responses := make(chan []byte)
 	complete := make(chan struct{}) // all gears received
+	var decodeErr error
 	go func() {
 		for response := range responses {
 			var gear Gear
-			err := unmarshal(response, &gear)
+			err := json.Unmarshal(response, &gear)
 			if err != nil {
-				log.Fatalf("couldn't unmarshal gear: %s", err)
+				if decodeErr == nil {
+					decodeErr = fmt.Errorf("couldn't unmarshal gear: %w", err)
+					cancel()
+				}
+				continue
 			}
+			gear.FetchedAt = time.Now()
 			gears = append(gears, gear)
 		}
 		complete <- struct{}{}
@@ -150,7 +407,7 @@ func (c *Client) worker(ctx context.Context, urls chan string, responses chan []
 				return err
 			}
 
-			data, err := c.fetchUrl(u)
+			data, err := c.fetchUrlRetry(ctx, u)
 			if err != nil {
 				return err
 			}
@@ -165,29 +422,98 @@ func (c *Client) worker(ctx context.Context, urls chan string, responses chan []
 	}
 }
 
-func (c *Client) fetchUrl(u *url.URL) ([]byte, error) {
-	req := &http.Request{
-		Method: "GET",
-		Header: map[string][]string{
-			"Authorization": {"Bearer " + c.creds.MustGetAccessToken()},
-		},
-		URL: u,
-	}
-	resp, err := c.hc.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	return ioutil.ReadAll(resp.Body)
+// fetchUrlRetry fetches u, retrying transient failures with jittered
+// exponential backoff.
+func (c *Client) fetchUrlRetry(ctx context.Context, u *url.URL) ([]byte, error) {
+	return c.requestRetry(ctx, "GET", u, "", nil)
 }
 
-func unmarshal(data []byte, v interface{}) error {
-	if isFault(data) {
-		return fmt.Errorf("client API error: %s", string(data))
+// requestRetry makes a request, retrying transient failures. Only idempotent
+// methods should be retried.
+func (c *Client) requestRetry(ctx context.Context, method string, u *url.URL, contentType string, body []byte) ([]byte, error) {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		data, err := c.request(ctx, method, u, contentType, body)
+		if err == nil || attempt == maxAttempts || !isTransient(err) {
+			return data, err
+		}
+		// "Full jitter": sleep for a random duration up to the backoff so
+		// that workers which failed together don't retry together.
+		delay := time.Duration(rand.Int63n(int64(backoff)))
+		log.Debugf("attempt %d of %s %s failed: %s; retrying in %s", attempt, method, u, err, delay)
+		err = sleep(ctx, delay)
+		if err != nil {
+			return nil, err
+		}
+		backoff *= 2
 	}
-	err := json.Unmarshal(data, v)
-	if err != nil {
-		return err
+}
+
+// request makes a request with a body of the given content type, or none if
+// body is nil. Rate limiting and expired tokens are handled here; other
+// failures are returned.
+func (c *Client) request(ctx context.Context, method string, u *url.URL, contentType string, body []byte) ([]byte, error) {
+	retried := false
+	for rateLimited := 0; ; {
+		err := c.limiter.wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), r)
+		if err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+		token, err := c.creds.AccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := c.hc.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		c.limiter.update(resp.Header)
+
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests:
+			// Drain the body so the connection can be reused, then wait for
+			// the next window before retrying.
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			c.limiter.exhaust()
+			log.Debug("rate limited fetching " + u.String())
+			rateLimited++
+			if rateLimited == maxRateLimited {
+				return nil, &RateLimitError{Reset: shortWindowStart(timeNow()).Add(shortWindow)}
+			}
+			continue
+		case resp.StatusCode == http.StatusUnauthorized && !retried:
+			// The token may have been revoked or expired early. Refresh it
+			// and try once more.
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			log.Debug("unauthorized fetching " + u.String() + "; refreshing token")
+			err = c.creds.Invalidate(ctx, token)
+			if err != nil {
+				return nil, err
+			}
+			retried = true
+			continue
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		return data, checkResponse(resp, data)
 	}
-	return nil
 }
@@ -0,0 +1,146 @@
+package strava_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/markdrayton/sls/strava"
+	"github.com/markdrayton/sls/stravatest"
+)
+
+const athleteId = 42
+
+func newClient(t *testing.T, srv *stravatest.Server, opts ...strava.Option) *strava.Client {
+	t.Helper()
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	err := srv.WriteToken(tokenPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]strava.Option{strava.WithBaseURL(srv.URL)}, opts...)
+	return strava.NewClient(stravatest.ClientId, stravatest.ClientSecret, tokenPath, opts...)
+}
+
+func TestGiveUpAfterRepeatedRateLimiting(t *testing.T) {
+	defer strava.FakeClock()()
+	srv := stravatest.NewServer(athleteId)
+	defer srv.Close()
+	srv.AddGear(strava.Gear{Id: "b1", Name: "R3"})
+	srv.Fail("/api/v3/gear/", stravatest.Fault{StatusCode: http.StatusTooManyRequests, Message: "Rate Limit Exceeded"})
+	c := newClient(t, srv)
+
+	_, err := c.Gears(context.Background(), []string{"b1"})
+	var rlErr *strava.RateLimitError
+	if !errors.As(err, &rlErr) || rlErr.Daily {
+		t.Fatalf("got error %v, want a short-term RateLimitError", err)
+	}
+	if got := srv.Requests(); got != 3 {
+		t.Errorf("made %d requests, want 3", got)
+	}
+}
+
+func TestDailyRateLimit(t *testing.T) {
+	defer strava.FakeClock()()
+	srv := stravatest.NewServer(athleteId)
+	defer srv.Close()
+	srv.AddGear(strava.Gear{Id: "b1", Name: "R3"})
+	srv.SetRateUsage(0, stravatest.DefaultLongLimit-1)
+	c := newClient(t, srv)
+
+	_, err := c.Gears(context.Background(), []string{"b1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// That used the last of the daily budget, so the next request isn't
+	// made.
+	_, err = c.Gears(context.Background(), []string{"b1"})
+	var rlErr *strava.RateLimitError
+	if !errors.As(err, &rlErr) || !rlErr.Daily {
+		t.Fatalf("got error %v, want a daily RateLimitError", err)
+	}
+	if !errors.Is(err, strava.ErrRateLimited) {
+		t.Errorf("%v doesn't match ErrRateLimited", err)
+	}
+	if got := srv.Requests(); got != 1 {
+		t.Errorf("made %d requests, want 1", got)
+	}
+}
+
+func TestRefreshAndRetryOnUnauthorized(t *testing.T) {
+	srv := stravatest.NewServer(athleteId)
+	defer srv.Close()
+	srv.AddGear(strava.Gear{Id: "b1", Name: "R3"})
+	// A token known to have expired is refreshed before it's used.
+	srv.ExpireToken()
+	c := newClient(t, srv)
+
+	requests := srv.Requests()
+	get := func(what string, want int) error {
+		t.Helper()
+		_, err := c.Gears(context.Background(), []string{"b1"})
+		if got := srv.Requests() - requests; got != want {
+			t.Errorf("%s: made %d requests, want %d", what, got, want)
+		}
+		requests = srv.Requests()
+		return err
+	}
+
+	err := get("expired token", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A token that stops working early is refreshed after the 401.
+	srv.RevokeAccessToken()
+	err = get("revoked token", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A request that's still unauthorized with a fresh token is only
+	// retried once.
+	srv.Fail("/api/v3/gear/", stravatest.Fault{StatusCode: http.StatusUnauthorized, Message: "Authorization Error"})
+	err = get("unauthorized request", 2)
+	if !errors.Is(err, strava.ErrUnauthorized) {
+		t.Errorf("got error %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	defer strava.FakeClock()()
+	srv := stravatest.NewServer(athleteId)
+	defer srv.Close()
+	start := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 250; i++ {
+		srv.AddActivities(strava.Activity{Id: int64(i + 1), StartDate: start.Add(time.Duration(i) * time.Hour)})
+	}
+	c := newClient(t, srv, strava.WithCheckpointDir(filepath.Join(t.TempDir(), "checkpoint")))
+
+	// A later epoch fetches pages one at a time, so page 1 is done before
+	// page 2 fails.
+	epoch := start.Add(-time.Hour)
+	page2 := fmt.Sprintf("/api/v3/athletes/%d/activities?after=%d&page=2&", athleteId, epoch.Unix())
+	srv.Fail(page2, stravatest.Fault{StatusCode: http.StatusServiceUnavailable, Message: "down", Times: 5})
+	_, err := c.Activities(context.Background(), athleteId, epoch)
+	if err == nil {
+		t.Fatal("fetch succeeded despite page 2 failing")
+	}
+	if got := srv.Requests(); got != 6 {
+		t.Errorf("made %d requests, want page 1 then 5 attempts at page 2", got)
+	}
+
+	// Page 1 has to come from the checkpoint now.
+	page1 := strings.Replace(page2, "page=2", "page=1", 1)
+	srv.Fail(page1, stravatest.Fault{StatusCode: http.StatusServiceUnavailable, Message: "down"})
+	activities, err := c.Activities(context.Background(), athleteId, epoch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 250 || activities[0].Id != 1 || activities[249].Id != 250 {
+		t.Errorf("got %d activities, want 1 to 250", len(activities))
+	}
+}
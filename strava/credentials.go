@@ -1,20 +1,38 @@
 package strava
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/markdrayton/sls/internal/atomicfile"
+)
+
+const (
+	urlAuthorize = "/oauth/authorize"
+	urlToken     = "/api/v3/oauth/token"
 )
 
-const urlToken = "https://www.strava.com/api/v3/oauth/token"
+// OAuth scopes (https://developers.strava.com/docs/authentication/).
+const (
+	ScopeRead            = "read"
+	ScopeReadAll         = "read_all"
+	ScopeProfileReadAll  = "profile:read_all"
+	ScopeActivityRead    = "activity:read"
+	ScopeActivityReadAll = "activity:read_all"
+	ScopeActivityWrite   = "activity:write"
+	ScopeProfileWrite    = "profile:write"
+)
 
 type Credentials struct {
+	baseURL      string
 	clientId     int
 	clientSecret string
 	tokenPath    string
@@ -25,6 +43,7 @@ type Credentials struct {
 
 func NewCredentials(clientId int, clientSecret, tokenPath string, hc *http.Client) *Credentials {
 	return &Credentials{
+		baseURL:      DefaultBaseURL,
 		clientId:     clientId,
 		clientSecret: clientSecret,
 		tokenPath:    tokenPath,
@@ -33,40 +52,58 @@ func NewCredentials(clientId int, clientSecret, tokenPath string, hc *http.Clien
 	}
 }
 
-func (c *Credentials) MustGetAccessToken() string {
+// AccessToken returns a bearer token for API requests, loading it from disk
+// and refreshing it if it has expired or is about to.
+func (c *Credentials) AccessToken(ctx context.Context) (string, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
-	if len(c.token.AccessToken) != 0 {
-		return c.token.AccessToken
+	if len(c.token.AccessToken) == 0 {
+		t, err := c.readToken()
+		if err != nil {
+			return "", err
+		}
+		c.token = t
 	}
-	err := c.getToken()
-	if err != nil {
-		log.Fatal(err)
+	if c.token.isExpired() {
+		err := c.refresh(ctx)
+		if err != nil {
+			return "", err
+		}
 	}
-	return c.token.AccessToken
+	return c.token.AccessToken, nil
 }
 
-func (c *Credentials) getToken() error {
+// Invalidate refreshes the token after the API rejected accessToken. If the
+// token has already been replaced, by another goroutine or by another process
+// sharing the token file, nothing is refreshed.
+func (c *Credentials) Invalidate(ctx context.Context, accessToken string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.token.AccessToken != accessToken {
+		return nil
+	}
 	t, err := c.readToken()
+	if err == nil && t.AccessToken != accessToken && !t.isExpired() {
+		c.token = t
+		return nil
+	}
+	return c.refresh(ctx)
+}
+
+// refresh exchanges the refresh token for a new token. Must be called with
+// the mutex held.
+func (c *Credentials) refresh(ctx context.Context) error {
+	data, err := c.postRefresh(ctx, c.token.RefreshToken)
 	if err != nil {
 		return err
 	}
-	if t.isExpired() {
-		data, err := c.postRefresh(t.RefreshToken)
-		if err != nil {
-			return err
-		}
-		if isFault(data) {
-			return fmt.Errorf("got an error response when updating token: %s", string(data))
-		}
-		t, err = unmarshalToken(data)
-		if err != nil {
-			return err
-		}
-		err = c.writeToken(data)
-		if err != nil {
-			return fmt.Errorf("couldn't write token data: %s", err)
-		}
+	t, err := unmarshalToken(data)
+	if err != nil {
+		return err
+	}
+	err = c.writeToken(data)
+	if err != nil {
+		return fmt.Errorf("couldn't write token data: %w", err)
 	}
 	c.token = t
 	return nil
@@ -75,7 +112,7 @@ func (c *Credentials) getToken() error {
 func (c *Credentials) readToken() (t token, err error) {
 	data, err := ioutil.ReadFile(c.tokenPath)
 	if err != nil {
-		return t, fmt.Errorf("couldn't read token data from %s", c.tokenPath)
+		return t, fmt.Errorf("couldn't read token data from %s: %w", c.tokenPath, err)
 	}
 	t, err = unmarshalToken(data)
 	if err != nil {
@@ -84,25 +121,91 @@ func (c *Credentials) readToken() (t token, err error) {
 	return t, err
 }
 
+// writeToken replaces the token file atomically so that a crash can't leave
+// it truncated and lose the refresh token.
 func (c *Credentials) writeToken(data []byte) error {
-	return ioutil.WriteFile(c.tokenPath, data, 0644)
+	return atomicfile.WriteFile(c.tokenPath, data, 0600)
+}
+
+// AuthorizeURL returns the page where an athlete grants access to the
+// application. Once access is granted Strava redirects to redirectURI, adding
+// "code" and "scope" query parameters.
+func (c *Credentials) AuthorizeURL(redirectURI string, scopes ...string) string {
+	q := url.Values{
+		"client_id":       []string{strconv.Itoa(c.clientId)},
+		"redirect_uri":    []string{redirectURI},
+		"response_type":   []string{"code"},
+		"approval_prompt": []string{"force"},
+		"scope":           []string{strings.Join(scopes, ",")},
+	}
+	return c.baseURL + urlAuthorize + "?" + q.Encode()
 }
 
-func (c *Credentials) postRefresh(refreshToken string) ([]byte, error) {
+// Exchange trades an authorization code obtained via AuthorizeURL for a
+// token, which is written to the token path. It returns the athlete who
+// granted access.
+func (c *Credentials) Exchange(ctx context.Context, code string) (Athlete, error) {
+	var resp struct {
+		token
+		Athlete Athlete `json:"athlete"`
+	}
+	form := url.Values{
+		"client_id":     []string{strconv.Itoa(c.clientId)},
+		"client_secret": []string{c.clientSecret},
+		"grant_type":    []string{"authorization_code"},
+		"code":          []string{code},
+	}
+	data, err := c.postToken(ctx, form)
+	if err != nil {
+		return resp.Athlete, fmt.Errorf("couldn't exchange authorization code: %w", err)
+	}
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return resp.Athlete, fmt.Errorf("couldn't unmarshal token data: %w", err)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	err = c.writeToken(data)
+	if err != nil {
+		return resp.Athlete, fmt.Errorf("couldn't write token data: %w", err)
+	}
+	c.token = resp.token
+	return resp.Athlete, nil
+}
+
+func (c *Credentials) postRefresh(ctx context.Context, refreshToken string) ([]byte, error) {
 	form := url.Values{
 		"client_id":     []string{strconv.Itoa(c.clientId)},
 		"client_secret": []string{c.clientSecret},
 		"grant_type":    []string{"refresh_token"},
 		"refresh_token": []string{refreshToken},
 	}
-	resp, err := c.hc.PostForm(urlToken, form)
+	data, err := c.postToken(ctx, form)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't refresh token: %s", err)
+		return nil, fmt.Errorf("couldn't refresh token: %w", err)
+	}
+	return data, nil
+}
+
+func (c *Credentials) postToken(ctx context.Context, form url.Values) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+urlToken, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("couldn't read token data stream: %s", err)
+		return nil, fmt.Errorf("couldn't read token data stream: %w", err)
+	}
+	err = checkResponse(resp, data)
+	if err != nil {
+		return nil, err
 	}
 	return data, nil
 }
@@ -120,7 +223,7 @@ func (t token) isExpired() bool {
 func unmarshalToken(data []byte) (t token, err error) {
 	err = json.Unmarshal(data, &t)
 	if err != nil {
-		return t, fmt.Errorf("couldn't unmarshal token data: %s", err)
+		return t, fmt.Errorf("couldn't unmarshal token data: %w", err)
 	}
 	return t, err
 }
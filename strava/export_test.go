@@ -0,0 +1,29 @@
+package strava
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// FakeClock makes rate limiting and retries use a clock that only moves
+// when they sleep. It returns a function that restores the real clock.
+func FakeClock() (restore func()) {
+	var mutex sync.Mutex
+	now := time.Now()
+	timeNow = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+	sleep = func(ctx context.Context, d time.Duration) error {
+		mutex.Lock()
+		now = now.Add(d)
+		mutex.Unlock()
+		return ctx.Err()
+	}
+	return func() {
+		timeNow = time.Now
+		sleep = sleepContext
+	}
+}
@@ -1,32 +1,122 @@
 package strava
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
-func isFault(data []byte) bool {
-	var f apiFault
-	err := json.Unmarshal(data, &f)
-	if err != nil {
-		// Failed to unmarshal into a Strava error: assume this is
-		// valid data. This test isn't conclusive as almost any hash
-		// will unmarshal into {[]}.
-		return false
-	}
-	// Messages present? Assume error.
-	if len(f.Message) > 0 {
-		return true
+var (
+	// ErrUnauthorized is matched by errors caused by a missing, expired or
+	// revoked access token, or one lacking the necessary scopes.
+	ErrUnauthorized = errors.New("strava: unauthorized")
+	// ErrRateLimited is matched by errors caused by exceeding the API rate
+	// limits. Use errors.As with *RateLimitError to find the reset time.
+	ErrRateLimited = errors.New("strava: rate limited")
+	// ErrNotFound is matched by errors for resources that don't exist or
+	// aren't visible to the authenticated athlete.
+	ErrNotFound = errors.New("strava: not found")
+)
+
+// RateLimitError reports that a rate limit was exhausted. Requests may
+// resume at Reset.
+type RateLimitError struct {
+	Reset time.Time
+	Daily bool
+}
+
+func (e *RateLimitError) Error() string {
+	window := "15-minute"
+	if e.Daily {
+		window = "daily"
 	}
-	return false
+	return fmt.Sprintf("%s Strava API limit reached; resets at %s",
+		window, e.Reset.Local().Format(time.RFC3339))
 }
 
-type apiError struct {
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// APIError is returned for non-2xx responses. It carries the HTTP status and
+// the fault document from the response body, if there was one.
+type APIError struct {
+	StatusCode int
+	Message    string
+	Errors     []ErrorDetail
+}
+
+// ErrorDetail (https://developers.strava.com/docs/reference/#api-models-Error)
+// describes one problem with a request.
+type ErrorDetail struct {
 	Code     string `json:"code"`
 	Field    string `json:"field"`
 	Resource string `json:"resource"`
 }
 
-type apiFault struct {
-	Message string     `json:"message"`
-	Errors  []apiError `json:"errors"`
+func (e *APIError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	details := make([]string, 0, len(e.Errors))
+	for _, ae := range e.Errors {
+		details = append(details, fmt.Sprintf("%s %s %s", ae.Resource, ae.Field, ae.Code))
+	}
+	if len(details) > 0 {
+		msg += " (" + strings.Join(details, "; ") + ")"
+	}
+	return fmt.Sprintf("Strava API error: HTTP %d: %s", e.StatusCode, msg)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// checkResponse classifies a response by its status code, returning nil for
+// success and an *APIError otherwise.
+func checkResponse(resp *http.Response, body []byte) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	// The body is normally a fault document but may be anything (an HTML
+	// error page from a proxy, say), so a decoding failure isn't an error.
+	var fault struct {
+		Message string        `json:"message"`
+		Errors  []ErrorDetail `json:"errors"`
+	}
+	json.Unmarshal(body, &fault)
+	return &APIError{StatusCode: resp.StatusCode, Message: fault.Message, Errors: fault.Errors}
+}
+
+// isTransient reports whether a failed request is worth retrying: network
+// failures and server errors are, whereas client errors and rate limiting
+// (which is handled separately) aren't.
+func isTransient(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF)
 }
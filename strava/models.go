@@ -1,6 +1,10 @@
 package strava
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/markdrayton/sls/geo"
@@ -8,11 +12,32 @@ import (
 
 // DetailedGear (https://bit.ly/2zD10Wv)
 type Gear struct {
-	Id   string `json:"id"`
-	Name string `json:"name"`
+	Id          string  `json:"id"`
+	Name        string  `json:"name"`
+	Primary     bool    `json:"primary"`
+	Retired     bool    `json:"retired"`
+	Distance    float64 `json:"distance"`
+	BrandName   string  `json:"brand_name"`
+	ModelName   string  `json:"model_name"`
+	FrameType   int     `json:"frame_type"`
+	Description string  `json:"description"`
+
+	// FetchedAt is when Client.Gears fetched the gear. It isn't part of the
+	// API.
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// IsBike reports whether the gear is a bike rather than shoes.
+func (g Gear) IsBike() bool {
+	return strings.HasPrefix(g.Id, "b")
 }
 
 // SummaryActivity (https://bit.ly/3bzRVuE)
+//
+// Raw holds the JSON object the activity was decoded from, including fields
+// that have no typed equivalent; read them with Field. An activity encodes
+// as Raw with the typed fields laid over it, so decoding that again keeps
+// every field, and fields added to the struct later are filled in from it.
 type Activity struct {
 	Id                 int64      `json:"id"`
 	Name               string     `json:"name"`
@@ -21,6 +46,7 @@ type Activity struct {
 	TotalElevationGain float64    `json:"total_elevation_gain"`
 	StartDateLocal     string     `json:"start_date_local"`
 	StartDate          time.Time  `json:"start_date"`
+	Timezone           string     `json:"timezone,omitempty"`
 	StartLatLng        geo.LatLng `json:"start_latlng"`
 	EndLatLng          geo.LatLng `json:"end_latlng"`
 	MovingTime         int        `json:"moving_time"`
@@ -29,10 +55,281 @@ type Activity struct {
 	AverageWatts       float64    `json:"average_watts"`
 	DeviceWatts        bool       `json:"device_watts"`
 	ExternalId         string     `json:"external_id"`
+	Commute            bool       `json:"commute"`
+	Trainer            bool       `json:"trainer"`
+
+	Raw json.RawMessage `json:"-"`
+}
+
+// activityFields has Activity's fields without its JSON methods.
+type activityFields Activity
+
+func (a *Activity) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	err := json.Unmarshal(data, (*activityFields)(a))
+	if err != nil {
+		return err
+	}
+	a.Raw = append(json.RawMessage(nil), data...)
+	return nil
+}
+
+func (a Activity) MarshalJSON() ([]byte, error) {
+	typed, err := json.Marshal(activityFields(a))
+	if err != nil || len(a.Raw) == 0 {
+		return typed, err
+	}
+	return mergeJSON(a.Raw, typed)
+}
+
+// StartTimeLocal returns the start time in the activity's time zone.
+// Strava gives the local time as if it were UTC, alongside the zone's name,
+// e.g. "(GMT+00:00) Europe/London". When the zone is unknown, or doesn't
+// agree with the times, a fixed zone is made from the difference between
+// them.
+func (a Activity) StartTimeLocal() (time.Time, error) {
+	wall, err := time.Parse(time.RFC3339, a.StartDateLocal)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid start_date_local %q", a.StartDateLocal)
+	}
+	if a.StartDate.IsZero() {
+		return wall, nil
+	}
+	if i := strings.LastIndex(a.Timezone, ") "); i >= 0 {
+		if loc := loadLocation(a.Timezone[i+2:]); loc != nil {
+			t := a.StartDate.In(loc)
+			if sameWallClock(t, wall) {
+				return t, nil
+			}
+		}
+	}
+	offset := wall.Sub(a.StartDate).Round(time.Minute)
+	return a.StartDate.In(time.FixedZone("", int(offset.Seconds()))), nil
+}
+
+func sameWallClock(t, wall time.Time) bool {
+	y, m, d := t.Date()
+	wy, wm, wd := wall.Date()
+	return y == wy && m == wm && d == wd && t.Hour() == wall.Hour() && t.Minute() == wall.Minute()
+}
+
+var (
+	locationsMutex sync.Mutex
+	locations      = make(map[string]*time.Location)
+)
+
+// loadLocation returns the named time zone, or nil if it's unknown. Zones
+// are cached, as loading one reads the zone database.
+func loadLocation(name string) *time.Location {
+	locationsMutex.Lock()
+	defer locationsMutex.Unlock()
+	loc, ok := locations[name]
+	if !ok {
+		loc, _ = time.LoadLocation(name)
+		locations[name] = loc
+	}
+	return loc
+}
+
+// Field decodes the named field of the raw activity into v, reporting
+// whether the field is present.
+func (a Activity) Field(name string, v interface{}) (bool, error) {
+	if len(a.Raw) == 0 {
+		return false, nil
+	}
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(a.Raw, &fields)
+	if err != nil {
+		return false, err
+	}
+	value, ok := fields[name]
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(value, v)
+}
+
+// mergeJSON returns the JSON object base with the fields of the JSON object
+// overlay added or replaced.
+func mergeJSON(base, overlay []byte) ([]byte, error) {
+	var fields, overlayFields map[string]json.RawMessage
+	err := json.Unmarshal(base, &fields)
+	if err == nil {
+		err = json.Unmarshal(overlay, &overlayFields)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		fields = make(map[string]json.RawMessage, len(overlayFields))
+	}
+	for k, v := range overlayFields {
+		fields[k] = v
+	}
+	return json.Marshal(fields)
 }
 
 type Activities []Activity
 
+// DetailedActivity (https://developers.strava.com/docs/reference/#api-models-DetailedActivity)
+type DetailedActivity struct {
+	Activity
+	ActivityDetail
+}
+
+// ActivityDetail holds the fields of a DetailedActivity that a
+// SummaryActivity doesn't have.
+type ActivityDetail struct {
+	Description          string  `json:"description"`
+	ElapsedTime          int     `json:"elapsed_time"`
+	AverageSpeed         float64 `json:"average_speed"`
+	MaxSpeed             float64 `json:"max_speed"`
+	AverageHeartrate     float64 `json:"average_heartrate"`
+	MaxHeartrate         float64 `json:"max_heartrate"`
+	AverageCadence       float64 `json:"average_cadence"`
+	WeightedAverageWatts float64 `json:"weighted_average_watts"`
+	MaxWatts             float64 `json:"max_watts"`
+	Calories             float64 `json:"calories"`
+	DeviceName           string  `json:"device_name"`
+	AchievementCount     int     `json:"achievement_count"`
+	KudosCount           int     `json:"kudos_count"`
+}
+
+// detailOnlyFields are the bulky fields of a DetailedActivity's JSON that
+// Summary drops.
+var detailOnlyFields = []string{
+	"segment_efforts", "splits_metric", "splits_standard", "laps", "best_efforts", "photos",
+}
+
+// Summary returns the activity without the bulky parts of its raw JSON, for
+// keeping alongside activities fetched in summary form.
+func (d DetailedActivity) Summary() Activity {
+	a := d.Activity
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(a.Raw, &fields) != nil {
+		return a
+	}
+	for _, name := range detailOnlyFields {
+		delete(fields, name)
+	}
+	if raw, err := json.Marshal(fields); err == nil {
+		a.Raw = raw
+	}
+	return a
+}
+
+// DetailedActivity needs its own JSON methods, as Activity's would otherwise
+// be promoted and skip the detail fields.
+
+func (d *DetailedActivity) UnmarshalJSON(data []byte) error {
+	err := d.Activity.UnmarshalJSON(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &d.ActivityDetail)
+}
+
+func (d DetailedActivity) MarshalJSON() ([]byte, error) {
+	activity, err := d.Activity.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	detail, err := json.Marshal(d.ActivityDetail)
+	if err != nil {
+		return nil, err
+	}
+	return mergeJSON(activity, detail)
+}
+
+// UpdatableActivity (https://developers.strava.com/docs/reference/#api-models-UpdatableActivity)
+// holds changes to an activity. Nil fields are left unchanged. Set GearId to
+// NoGear to remove an activity's gear.
+type UpdatableActivity struct {
+	Name        *string `json:"name,omitempty"`
+	Type        *string `json:"type,omitempty"`
+	GearId      *string `json:"gear_id,omitempty"`
+	Commute     *bool   `json:"commute,omitempty"`
+	Trainer     *bool   `json:"trainer,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+// NoGear is the gear ID that removes an activity's gear in an update.
+const NoGear = "none"
+
 func (a Activities) Len() int           { return len(a) }
 func (a Activities) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a Activities) Less(i, j int) bool { return a[i].StartDate.Before(a[j].StartDate) }
+
+// SummaryAthlete (https://developers.strava.com/docs/reference/#api-models-SummaryAthlete)
+type Athlete struct {
+	Id        int64  `json:"id"`
+	Username  string `json:"username"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+}
+
+// Stream types (https://developers.strava.com/docs/reference/#api-models-StreamSet)
+const (
+	StreamTime           = "time"
+	StreamDistance       = "distance"
+	StreamLatLng         = "latlng"
+	StreamAltitude       = "altitude"
+	StreamVelocitySmooth = "velocity_smooth"
+	StreamHeartrate      = "heartrate"
+	StreamCadence        = "cadence"
+	StreamWatts          = "watts"
+	StreamTemp           = "temp"
+	StreamMoving         = "moving"
+	StreamGradeSmooth    = "grade_smooth"
+)
+
+// AllStreams lists every stream type.
+var AllStreams = []string{
+	StreamTime, StreamDistance, StreamLatLng, StreamAltitude, StreamVelocitySmooth,
+	StreamHeartrate, StreamCadence, StreamWatts, StreamTemp, StreamMoving, StreamGradeSmooth,
+}
+
+type StreamMeta struct {
+	OriginalSize int    `json:"original_size"`
+	Resolution   string `json:"resolution"`
+	SeriesType   string `json:"series_type"`
+}
+
+type IntStream struct {
+	StreamMeta
+	Data []int `json:"data"`
+}
+
+type FloatStream struct {
+	StreamMeta
+	Data []float64 `json:"data"`
+}
+
+type LatLngStream struct {
+	StreamMeta
+	Data []geo.LatLng `json:"data"`
+}
+
+type BoolStream struct {
+	StreamMeta
+	Data []bool `json:"data"`
+}
+
+// StreamSet holds an activity's streams. Streams the activity doesn't have,
+// or that weren't requested, are nil. Samples at the same index in different
+// streams were recorded together.
+type StreamSet struct {
+	Time           *IntStream    `json:"time,omitempty"`
+	Distance       *FloatStream  `json:"distance,omitempty"`
+	LatLng         *LatLngStream `json:"latlng,omitempty"`
+	Altitude       *FloatStream  `json:"altitude,omitempty"`
+	VelocitySmooth *FloatStream  `json:"velocity_smooth,omitempty"`
+	Heartrate      *IntStream    `json:"heartrate,omitempty"`
+	Cadence        *IntStream    `json:"cadence,omitempty"`
+	Watts          *IntStream    `json:"watts,omitempty"`
+	Temp           *IntStream    `json:"temp,omitempty"`
+	Moving         *BoolStream   `json:"moving,omitempty"`
+	GradeSmooth    *FloatStream  `json:"grade_smooth,omitempty"`
+}
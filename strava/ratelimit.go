@@ -0,0 +1,282 @@
+package strava
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/markdrayton/sls/internal/atomicfile"
+)
+
+// Strava applies two limits to each application: a short-term limit that
+// resets at natural 15-minute boundaries (hh:00, hh:15, ...) and a daily
+// limit that resets at midnight UTC. Every response reports both limits and
+// the current usage as "short,long" pairs.
+const (
+	headerRateLimit = "X-RateLimit-Limit"
+	headerRateUsage = "X-RateLimit-Usage"
+
+	shortWindow = 15 * time.Minute
+
+	// Strava's default short-term limit, assumed when a 429 arrives before
+	// any limits have been reported.
+	defaultShortLimit = 100
+
+	// Start spacing requests out once this fraction of the short-term
+	// budget has been used.
+	throttleFraction = 0.8
+
+	// Give up after this many 429 responses in a row, in case a limit
+	// doesn't reset when it should.
+	maxRateLimited = 3
+)
+
+type rateLimit struct {
+	ShortLimit int       `json:"short_limit"`
+	ShortUsage int       `json:"short_usage"`
+	LongLimit  int       `json:"long_limit"`
+	LongUsage  int       `json:"long_usage"`
+	Updated    time.Time `json:"updated"`
+}
+
+// expire zeroes usage counts that belong to windows which have since ended.
+func (r *rateLimit) expire(now time.Time) {
+	if !r.Updated.Before(shortWindowStart(now)) {
+		return
+	}
+	r.ShortUsage = 0
+	if r.Updated.Before(longWindowStart(now)) {
+		r.LongUsage = 0
+	}
+}
+
+type rateLimiter struct {
+	path  string
+	mutex *sync.Mutex
+	state rateLimit
+	// saved is the state last read from or written to path.
+	saved rateLimit
+}
+
+// newRateLimiter returns a limiter whose state is persisted to path so that
+// usage recorded by earlier runs (or by other users of the same application)
+// is taken into account. An empty path disables persistence.
+func newRateLimiter(path string) *rateLimiter {
+	rl := &rateLimiter{
+		path:  path,
+		mutex: &sync.Mutex{},
+	}
+	if path != "" {
+		err := rl.load()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("couldn't read rate limit state from %s: %s", path, err)
+		}
+	}
+	return rl
+}
+
+// wait blocks until the next request may be made, reserving a slot in the
+// current window. It returns an error if the daily budget has been used up,
+// ctx is cancelled, or ctx's deadline would pass before the short-term
+// budget resets.
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	for {
+		retry, pause, err := rl.reserve()
+		if err != nil {
+			return err
+		}
+		if retry > 0 {
+			reset := timeNow().Add(retry)
+			if deadline, ok := ctx.Deadline(); ok && deadline.Before(reset) {
+				return &RateLimitError{Reset: reset}
+			}
+			log.Infof("15-minute Strava API limit reached; waiting %s", retry.Round(time.Second))
+			err = sleep(ctx, retry)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if pause > 0 {
+			log.Debugf("rate limit: throttling for %s", pause)
+			return sleep(ctx, pause)
+		}
+		return nil
+	}
+}
+
+// reserve claims a request slot, returning how long to pause before using
+// it. If no slot is available it returns how long to wait before retrying.
+func (rl *rateLimiter) reserve() (retry, pause time.Duration, err error) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	now := timeNow()
+	s := &rl.state
+	s.expire(now)
+
+	if s.LongLimit > 0 && s.LongUsage >= s.LongLimit {
+		return 0, 0, &RateLimitError{
+			Reset: longWindowStart(now).Add(24 * time.Hour),
+			Daily: true,
+		}
+	}
+
+	if s.ShortLimit > 0 {
+		remaining := s.ShortLimit - s.ShortUsage
+		untilReset := shortWindowStart(now).Add(shortWindow).Sub(now)
+		if remaining <= 0 {
+			return untilReset, 0, nil
+		}
+		if float64(s.ShortUsage) >= throttleFraction*float64(s.ShortLimit) {
+			// Spread the remaining budget over the rest of the window.
+			pause = untilReset / time.Duration(remaining)
+		}
+	}
+
+	s.ShortUsage++
+	s.LongUsage++
+	s.Updated = now
+	return 0, pause, nil
+}
+
+// update records the limits and usage reported in a response's headers.
+func (rl *rateLimiter) update(h http.Header) {
+	limits, ok := parseRatePair(h.Get(headerRateLimit))
+	if !ok {
+		return
+	}
+	usage, ok := parseRatePair(h.Get(headerRateUsage))
+	if !ok {
+		return
+	}
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	rl.state = rateLimit{
+		ShortLimit: limits[0],
+		ShortUsage: usage[0],
+		LongLimit:  limits[1],
+		LongUsage:  usage[1],
+		Updated:    timeNow(),
+	}
+	if rl.changed() {
+		rl.save()
+	}
+}
+
+// changed reports whether the state differs from the saved state in a way
+// that would change how the next run paces its first requests: the limits
+// differ, or usage differs and either is near a limit. Every response
+// reports the usage, so below that it needn't be saved. Must be called with
+// the mutex held.
+func (rl *rateLimiter) changed() bool {
+	s, saved := rl.state, rl.saved
+	if s.ShortLimit != saved.ShortLimit || s.LongLimit != saved.LongLimit {
+		return true
+	}
+	if s.ShortUsage == saved.ShortUsage && s.LongUsage == saved.LongUsage {
+		return false
+	}
+	return s.nearLimit() || saved.nearLimit()
+}
+
+// nearLimit reports whether requests are being throttled or refused.
+func (r *rateLimit) nearLimit() bool {
+	return r.ShortLimit > 0 && float64(r.ShortUsage) >= throttleFraction*float64(r.ShortLimit) ||
+		r.LongLimit > 0 && r.LongUsage >= r.LongLimit
+}
+
+// exhaust marks the short-term budget as used up after a 429 response that
+// didn't carry usable headers.
+func (rl *rateLimiter) exhaust() {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if rl.state.ShortLimit == 0 {
+		rl.state.ShortLimit = defaultShortLimit
+	}
+	rl.state.ShortUsage = rl.state.ShortLimit
+	rl.state.Updated = timeNow()
+	rl.save()
+}
+
+func (rl *rateLimiter) load() error {
+	data, err := ioutil.ReadFile(rl.path)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &rl.state)
+	rl.saved = rl.state
+	return err
+}
+
+// save persists the current state. Must be called with the mutex held.
+func (rl *rateLimiter) save() {
+	if rl.path == "" {
+		return
+	}
+	data, err := json.Marshal(rl.state)
+	if err != nil {
+		log.Warnf("couldn't marshal rate limit state: %s", err)
+		return
+	}
+	err = atomicfile.WriteFile(rl.path, data, 0644)
+	if err != nil {
+		log.Warnf("couldn't write rate limit state to %s: %s", rl.path, err)
+		return
+	}
+	rl.saved = rl.state
+}
+
+func parseRatePair(s string) (pair [2]int, ok bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return pair, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return pair, false
+		}
+		pair[i] = n
+	}
+	return pair, true
+}
+
+func shortWindowStart(t time.Time) time.Time {
+	return t.UTC().Truncate(shortWindow)
+}
+
+func longWindowStart(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// timeNow and sleep are the clock used for rate limiting and retries. Tests
+// replace them so they needn't wait for real windows to reset.
+var (
+	timeNow = time.Now
+	sleep   = sleepContext
+)
+
+// sleepContext pauses for d or until ctx is cancelled, whichever comes
+// first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,203 @@
+package strava
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const urlUploads = "/api/v3/uploads"
+const urlUpload = "/api/v3/uploads/%d"
+
+// Strava asks that upload status is polled no more than once a second.
+const uploadPollInterval = time.Second
+
+// Data types accepted by the uploads endpoint, by file extension.
+var uploadDataTypes = []string{"fit", "fit.gz", "tcx", "tcx.gz", "gpx", "gpx.gz"}
+
+// Processing failures for files that were already uploaded look like
+// "ride.fit duplicate of activity 123" or, in older responses, link to it.
+var reDuplicate = regexp.MustCompile(`duplicate of (?:activity |<a href='/activities/)(\d+)`)
+
+// ErrDuplicate is matched by upload errors for files that were already
+// uploaded. Use errors.As with *UploadError to find the existing activity.
+var ErrDuplicate = errors.New("strava: duplicate activity")
+
+// Upload (https://developers.strava.com/docs/reference/#api-models-Upload)
+// describes an uploaded file being processed into an activity.
+type Upload struct {
+	Id         int64  `json:"id"`
+	ExternalId string `json:"external_id"`
+	Error      string `json:"error"`
+	Status     string `json:"status"`
+	ActivityId int64  `json:"activity_id"`
+}
+
+// Done reports whether Strava has finished processing the upload, either
+// successfully or not.
+func (u Upload) Done() bool {
+	return u.ActivityId != 0 || u.Error != ""
+}
+
+// UploadParams sets optional properties of an uploaded activity.
+type UploadParams struct {
+	Name        string
+	Description string
+	Trainer     bool
+	Commute     bool
+	// DataType is one of fit, fit.gz, tcx, tcx.gz, gpx or gpx.gz. If empty
+	// it is taken from the file name's extension.
+	DataType string
+	// ExternalId defaults to the file name.
+	ExternalId string
+}
+
+// UploadError reports that Strava couldn't turn an upload into an activity.
+// DuplicateOf is the ID of the existing activity if the file was a
+// duplicate.
+type UploadError struct {
+	Upload      Upload
+	DuplicateOf int64
+}
+
+func (e *UploadError) Error() string {
+	return "Strava couldn't process upload: " + e.Upload.Error
+}
+
+func (e *UploadError) Is(target error) bool {
+	return target == ErrDuplicate && e.DuplicateOf != 0
+}
+
+// Upload uploads an activity file. Strava processes the file asynchronously;
+// use WaitForUpload to find the resulting activity. Requires the
+// activity:write scope.
+func (c *Client) Upload(ctx context.Context, filename string, data []byte, params UploadParams) (Upload, error) {
+	var upload Upload
+	u, err := url.Parse(c.baseURL + urlUploads)
+	if err != nil {
+		return upload, err
+	}
+
+	if params.DataType == "" {
+		params.DataType = dataType(filename)
+		if params.DataType == "" {
+			return upload, fmt.Errorf("can't tell the type of %s; expected one of %s",
+				filename, strings.Join(uploadDataTypes, ", "))
+		}
+	}
+	if params.ExternalId == "" {
+		params.ExternalId = filepath.Base(filename)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fields := [][2]string{
+		{"data_type", params.DataType},
+		{"external_id", params.ExternalId},
+		{"name", params.Name},
+		{"description", params.Description},
+	}
+	if params.Trainer {
+		fields = append(fields, [2]string{"trainer", "1"})
+	}
+	if params.Commute {
+		fields = append(fields, [2]string{"commute", "1"})
+	}
+	for _, f := range fields {
+		if f[1] != "" {
+			mw.WriteField(f[0], f[1])
+		}
+	}
+	fw, err := mw.CreateFormFile("file", filepath.Base(filename))
+	if err != nil {
+		return upload, err
+	}
+	fw.Write(data)
+	err = mw.Close()
+	if err != nil {
+		return upload, err
+	}
+
+	log.Debugf("uploading %s to %s", filename, u)
+	// Not retried: a retry after a lost response would be a duplicate.
+	resp, err := c.request(ctx, "POST", u, mw.FormDataContentType(), body.Bytes())
+	if err != nil {
+		return upload, err
+	}
+	err = json.Unmarshal(resp, &upload)
+	if err != nil {
+		return upload, fmt.Errorf("couldn't unmarshal upload: %w", err)
+	}
+	return upload, uploadError(upload)
+}
+
+// UploadStatus fetches the processing status of an upload.
+func (c *Client) UploadStatus(ctx context.Context, id int64) (Upload, error) {
+	var upload Upload
+	u, err := url.Parse(c.baseURL + fmt.Sprintf(urlUpload, id))
+	if err != nil {
+		return upload, err
+	}
+	log.Debug("fetching " + u.String())
+	data, err := c.fetchUrlRetry(ctx, u)
+	if err != nil {
+		return upload, err
+	}
+	err = json.Unmarshal(data, &upload)
+	if err != nil {
+		return upload, fmt.Errorf("couldn't unmarshal upload: %w", err)
+	}
+	return upload, nil
+}
+
+// WaitForUpload polls an upload's status until Strava has processed it. An
+// upload that fails processing returns an *UploadError.
+func (c *Client) WaitForUpload(ctx context.Context, upload Upload) (Upload, error) {
+	var err error
+	for !upload.Done() {
+		err = sleep(ctx, uploadPollInterval)
+		if err != nil {
+			return upload, err
+		}
+		upload, err = c.UploadStatus(ctx, upload.Id)
+		if err != nil {
+			return upload, err
+		}
+		log.Debugf("upload %d: %s", upload.Id, upload.Status)
+	}
+	return upload, uploadError(upload)
+}
+
+func uploadError(upload Upload) error {
+	if upload.Error == "" {
+		return nil
+	}
+	e := &UploadError{Upload: upload}
+	if m := reDuplicate.FindStringSubmatch(upload.Error); m != nil {
+		e.DuplicateOf, _ = strconv.ParseInt(m[1], 10, 64)
+	}
+	return e
+}
+
+// dataType returns the upload data type for a file name, or "" if the
+// extension isn't one Strava accepts.
+func dataType(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, t := range uploadDataTypes {
+		if strings.HasSuffix(lower, "."+t) {
+			return t
+		}
+	}
+	return ""
+}
@@ -0,0 +1,209 @@
+package strava
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const urlSubscriptions = "/api/v3/push_subscriptions"
+const urlSubscription = "/api/v3/push_subscriptions/%d"
+
+// Webhook event object and aspect types.
+const (
+	ObjectActivity = "activity"
+	ObjectAthlete  = "athlete"
+
+	AspectCreate = "create"
+	AspectUpdate = "update"
+	AspectDelete = "delete"
+)
+
+// WebhookEvent (https://developers.strava.com/docs/webhooks/) reports a
+// change to an activity or athlete. Updates holds the changed fields of an
+// update event, e.g. "title", "type", "private", or "authorized" with value
+// "false" when an athlete revokes access. Strava documents the values as
+// strings but has been seen to send booleans.
+type WebhookEvent struct {
+	ObjectType     string                 `json:"object_type"`
+	ObjectId       int64                  `json:"object_id"`
+	AspectType     string                 `json:"aspect_type"`
+	Updates        map[string]interface{} `json:"updates"`
+	OwnerId        int64                  `json:"owner_id"`
+	SubscriptionId int64                  `json:"subscription_id"`
+	EventTime      int64                  `json:"event_time"`
+}
+
+// Deauthorized reports whether the event is an athlete revoking access.
+func (e WebhookEvent) Deauthorized() bool {
+	return e.ObjectType == ObjectAthlete && fmt.Sprint(e.Updates["authorized"]) == "false"
+}
+
+// Subscription is an application's webhook subscription.
+type Subscription struct {
+	Id            int64     `json:"id"`
+	ApplicationId int64     `json:"application_id"`
+	CallbackURL   string    `json:"callback_url"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// WebhookHandler is an http.Handler for a webhook callback URL. It answers
+// the validation request Strava makes when subscribing and queues events on
+// a channel for the caller to process, since Strava expects events to be
+// acknowledged within two seconds.
+//
+// Strava doesn't sign events. The handler checks the verify token on
+// validation requests and, if a subscription ID is given, rejects events
+// for other subscriptions; a hard-to-guess callback URL path helps too.
+type WebhookHandler struct {
+	verifyToken    string
+	subscriptionId int64
+	events         chan<- WebhookEvent
+}
+
+// NewWebhookHandler returns a handler that accepts subscriptions made with
+// verifyToken and sends events to events. If subscriptionId is zero events
+// from any subscription are accepted.
+func NewWebhookHandler(verifyToken string, subscriptionId int64, events chan<- WebhookEvent) *WebhookHandler {
+	return &WebhookHandler{
+		verifyToken:    verifyToken,
+		subscriptionId: subscriptionId,
+		events:         events,
+	}
+}
+
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		h.validate(w, r)
+	case "POST":
+		h.receive(w, r)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// validate answers a subscription validation request by echoing its
+// challenge.
+func (h *WebhookHandler) validate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	token := q.Get("hub.verify_token")
+	if q.Get("hub.mode") != "subscribe" || subtle.ConstantTimeCompare([]byte(token), []byte(h.verifyToken)) != 1 {
+		log.Warnf("rejected webhook validation request from %s", r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"hub.challenge": q.Get("hub.challenge")})
+}
+
+func (h *WebhookHandler) receive(w http.ResponseWriter, r *http.Request) {
+	var event WebhookEvent
+	err := json.NewDecoder(r.Body).Decode(&event)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if h.subscriptionId != 0 && event.SubscriptionId != h.subscriptionId {
+		log.Warnf("rejected event for subscription %d from %s", event.SubscriptionId, r.RemoteAddr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	select {
+	case h.events <- event:
+	default:
+		// Strava retries events that aren't acknowledged.
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+	}
+}
+
+// Subscribe creates the application's webhook subscription. Strava validates
+// callbackURL before replying, so a WebhookHandler using verifyToken must
+// already be serving it.
+func (c *Client) Subscribe(ctx context.Context, callbackURL, verifyToken string) (Subscription, error) {
+	var sub Subscription
+	form := c.appCredentials()
+	form.Set("callback_url", callbackURL)
+	form.Set("verify_token", verifyToken)
+	data, err := c.appRequest(ctx, "POST", urlSubscriptions, form)
+	if err != nil {
+		return sub, fmt.Errorf("couldn't subscribe: %w", err)
+	}
+	err = json.Unmarshal(data, &sub)
+	if err != nil {
+		return sub, fmt.Errorf("couldn't unmarshal subscription: %w", err)
+	}
+	sub.CallbackURL = callbackURL
+	return sub, nil
+}
+
+// Subscriptions lists the application's webhook subscriptions. Strava allows
+// at most one.
+func (c *Client) Subscriptions(ctx context.Context) ([]Subscription, error) {
+	var subs []Subscription
+	data, err := c.appRequest(ctx, "GET", urlSubscriptions, c.appCredentials())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list subscriptions: %w", err)
+	}
+	err = json.Unmarshal(data, &subs)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal subscriptions: %w", err)
+	}
+	return subs, nil
+}
+
+// Unsubscribe deletes a webhook subscription.
+func (c *Client) Unsubscribe(ctx context.Context, id int64) error {
+	_, err := c.appRequest(ctx, "DELETE", fmt.Sprintf(urlSubscription, id), c.appCredentials())
+	if err != nil {
+		return fmt.Errorf("couldn't unsubscribe: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) appCredentials() url.Values {
+	return url.Values{
+		"client_id":     []string{strconv.Itoa(c.creds.clientId)},
+		"client_secret": []string{c.creds.clientSecret},
+	}
+}
+
+// appRequest makes a request authenticated by the application's client ID
+// and secret rather than an athlete's token, as subscription management is.
+// The credentials go in the body of a POST and the query otherwise.
+func (c *Client) appRequest(ctx context.Context, method, path string, form url.Values) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if method == "POST" {
+		req, err = http.NewRequestWithContext(ctx, method, c.baseURL+path, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, method, c.baseURL+path+"?"+form.Encode(), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("%s %s", method, c.baseURL+path)
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return data, checkResponse(resp, data)
+}
@@ -0,0 +1,890 @@
+// Package stravatest provides an in-memory fake of the Strava API for use in
+// tests of code built on the strava package.
+//
+// A Server serves the athlete, paginated athlete activities, individual
+// activities and their streams, gear, OAuth authorization and token
+// refreshes, and accepts activity updates and uploads. A webhook
+// subscription receives events for changes made through the API or with
+// DeleteActivity, Deauthorize and SendEvent. It tracks rate-limit usage and
+// can be told to fail requests:
+//
+//	srv := stravatest.NewServer(athleteId)
+//	defer srv.Close()
+//	srv.AddActivities(activities...)
+//	srv.WriteToken(tokenPath)
+//	c := strava.NewClient(stravatest.ClientId, stravatest.ClientSecret, tokenPath,
+//		strava.WithBaseURL(srv.URL))
+package stravatest
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/markdrayton/sls/strava"
+)
+
+// Credentials accepted by the token endpoint.
+const (
+	ClientId     = 1234
+	ClientSecret = "stravatest-secret"
+	// AuthCode is the authorization code issued by the authorize endpoint.
+	AuthCode = "stravatest-code"
+)
+
+// Default rate limits, matching those Strava gives new applications.
+const (
+	DefaultShortLimit = 100
+	DefaultLongLimit  = 1000
+)
+
+const tokenLifetime = 6 * time.Hour
+
+var (
+	reActivities   = regexp.MustCompile(`^/api/v3/athletes/(\d+)/activities$`)
+	reActivity     = regexp.MustCompile(`^/api/v3/activities/(\d+)$`)
+	reStreams      = regexp.MustCompile(`^/api/v3/activities/(\d+)/streams$`)
+	reGear         = regexp.MustCompile(`^/api/v3/gear/([^/]+)$`)
+	reUpload       = regexp.MustCompile(`^/api/v3/uploads/(\d+)$`)
+	reSubscription = regexp.MustCompile(`^/api/v3/push_subscriptions/(\d+)$`)
+)
+
+// Fault is a canned error response returned by a Server.
+type Fault struct {
+	StatusCode int
+	Message    string
+	// Times is the number of requests the fault applies to; zero means
+	// every request.
+	Times int
+}
+
+// Token is an OAuth token issued by a Server.
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// upload is a file being "processed". It becomes an activity, or fails as a
+// duplicate, the first time its status is fetched.
+type upload struct {
+	strava.Upload
+	activity    strava.Activity
+	duplicateOf int64
+}
+
+// delivery is an event to post to a subscription's callback URL.
+type delivery struct {
+	callbackURL string
+	event       strava.WebhookEvent
+}
+
+type Server struct {
+	*httptest.Server
+
+	mutex      *sync.Mutex
+	athleteId  int64
+	activities strava.Activities
+	details    map[int64]strava.DetailedActivity
+	streams    map[int64]strava.StreamSet
+	gear       map[string]strava.Gear
+	uploads    []*upload
+	uploaded   map[[sha1.Size]byte]int64
+	sub        *strava.Subscription
+	subs       int64
+	deliveries []delivery    // events waiting to be posted
+	wake       chan struct{} // signalled when deliveries are queued
+	done       chan struct{} // closed by Close
+	closed     bool
+	token      Token
+	issued     int
+	faults     map[string]*Fault
+	shortLimit int
+	longLimit  int
+	shortUsage int
+	longUsage  int
+	requests   int
+}
+
+// NewServer starts a fake Strava API for athleteId. The caller should call
+// Close when finished.
+func NewServer(athleteId int64) *Server {
+	s := &Server{
+		mutex:      &sync.Mutex{},
+		athleteId:  athleteId,
+		details:    make(map[int64]strava.DetailedActivity),
+		streams:    make(map[int64]strava.StreamSet),
+		gear:       make(map[string]strava.Gear),
+		uploaded:   make(map[[sha1.Size]byte]int64),
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		faults:     make(map[string]*Fault),
+		shortLimit: DefaultShortLimit,
+		longLimit:  DefaultLongLimit,
+	}
+	s.issueToken(time.Now().Add(tokenLifetime))
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	go s.deliverEvents()
+	return s
+}
+
+// Close shuts down the server, dropping any undelivered events.
+func (s *Server) Close() {
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	s.mutex.Unlock()
+	s.Server.Close()
+}
+
+// AddActivities adds activities to the athlete's history.
+func (s *Server) AddActivities(activities ...strava.Activity) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.activities = append(s.activities, activities...)
+	sort.Sort(s.activities)
+}
+
+// AddDetailedActivities adds activities to the athlete's history along with
+// the details returned when they are fetched individually. Activities added
+// with AddActivities are returned without details.
+func (s *Server) AddDetailedActivities(activities ...strava.DetailedActivity) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, a := range activities {
+		s.activities = append(s.activities, a.Activity)
+		s.details[a.Id] = a
+	}
+	sort.Sort(s.activities)
+}
+
+// AddStreams sets the streams of activity id. Activities without streams
+// return 404, as manually entered activities do.
+func (s *Server) AddStreams(id int64, streams strava.StreamSet) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.streams[id] = streams
+}
+
+// AddGear adds gear that can be fetched by ID.
+func (s *Server) AddGear(gear ...strava.Gear) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, g := range gear {
+		s.gear[g.Id] = g
+	}
+}
+
+// DeleteActivity removes an activity, as if the athlete had deleted it, and
+// sends a delete event to the webhook subscription if there is one.
+func (s *Server) DeleteActivity(id int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if i := s.findActivity(id); i >= 0 {
+		s.activities = append(s.activities[:i], s.activities[i+1:]...)
+		delete(s.details, id)
+		delete(s.streams, id)
+		s.queueEvent(strava.ObjectActivity, id, strava.AspectDelete, nil)
+	}
+}
+
+// Deauthorize revokes the athlete's token, as if they had removed the
+// application's access, and sends a deauthorization event to the webhook
+// subscription if there is one.
+func (s *Server) Deauthorize() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.issueToken(time.Now().Add(tokenLifetime))
+	s.token.RefreshToken = ""
+	s.queueEvent(strava.ObjectAthlete, s.athleteId, strava.AspectUpdate,
+		map[string]interface{}{"authorized": "false"})
+}
+
+// SendEvent sends an arbitrary event to the webhook subscription. The
+// subscription ID, owner and time are filled in if not set. Events are
+// posted asynchronously and in order. Activities created, updated or
+// deleted through the API send their own events.
+func (s *Server) SendEvent(event strava.WebhookEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sub == nil {
+		return
+	}
+	if event.SubscriptionId == 0 {
+		event.SubscriptionId = s.sub.Id
+	}
+	if event.OwnerId == 0 {
+		event.OwnerId = s.athleteId
+	}
+	if event.EventTime == 0 {
+		event.EventTime = time.Now().Unix()
+	}
+	s.deliver(delivery{s.sub.CallbackURL, event})
+}
+
+// Token returns the currently valid token.
+func (s *Server) Token() Token {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.token
+}
+
+// ExpireToken marks the current access token as expired, forcing clients to
+// refresh it.
+func (s *Server) ExpireToken() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.token.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+}
+
+// RevokeAccessToken invalidates the current access token without telling
+// clients, which will see 401 responses until they refresh it. The refresh
+// token remains valid.
+func (s *Server) RevokeAccessToken() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.token.AccessToken += "-revoked"
+}
+
+// WriteToken writes the current token to path in the format expected by
+// strava.Credentials.
+func (s *Server) WriteToken(path string) error {
+	data, err := json.Marshal(s.Token())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Fail makes requests whose path, followed by its query, starts with prefix
+// return f. A prefix with a query selects particular pages of a listing.
+func (s *Server) Fail(prefix string, f Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults[prefix] = &f
+}
+
+// SetRateLimits sets the 15-minute and daily request limits.
+func (s *Server) SetRateLimits(short, long int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shortLimit = short
+	s.longLimit = long
+}
+
+// SetRateUsage sets the usage counts reported against the limits, as if
+// other clients of the same application had made requests.
+func (s *Server) SetRateUsage(short, long int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.shortUsage = short
+	s.longUsage = long
+}
+
+// Requests returns the number of API requests served, excluding token
+// requests.
+func (s *Server) Requests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.requests
+}
+
+// issueToken creates a new token. Must be called with the mutex held.
+func (s *Server) issueToken(expiresAt time.Time) {
+	s.issued++
+	s.token = Token{
+		AccessToken:  fmt.Sprintf("access-%d", s.issued),
+		ExpiresAt:    expiresAt.Unix(),
+		RefreshToken: fmt.Sprintf("refresh-%d", s.issued),
+	}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch r.URL.Path {
+	case "/oauth/authorize":
+		s.serveAuthorize(w, r)
+		return
+	case "/api/v3/oauth/token":
+		s.serveToken(w, r)
+		return
+	}
+	if r.URL.Path == "/api/v3/push_subscriptions" || reSubscription.MatchString(r.URL.Path) {
+		s.serveSubscriptions(w, r)
+		return
+	}
+
+	s.requests++
+	s.shortUsage++
+	s.longUsage++
+	w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d,%d", s.shortLimit, s.longLimit))
+	w.Header().Set("X-RateLimit-Usage", fmt.Sprintf("%d,%d", s.shortUsage, s.longUsage))
+	if s.shortUsage > s.shortLimit || s.longUsage > s.longLimit {
+		writeFault(w, http.StatusTooManyRequests, "Rate Limit Exceeded")
+		return
+	}
+
+	if !s.authorized(r) {
+		writeFault(w, http.StatusUnauthorized, "Authorization Error")
+		return
+	}
+
+	if s.fault(w, r) {
+		return
+	}
+
+	if m := reActivities.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "GET" {
+		s.serveActivities(w, r, m[1])
+		return
+	}
+	if m := reActivity.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "GET" {
+		s.serveActivity(w, m[1])
+		return
+	}
+	if m := reActivity.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "PUT" {
+		s.updateActivity(w, r, m[1])
+		return
+	}
+	if m := reStreams.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "GET" {
+		s.serveStreams(w, r, m[1])
+		return
+	}
+	if m := reGear.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "GET" {
+		s.serveGear(w, m[1])
+		return
+	}
+	if r.URL.Path == "/api/v3/athlete" && r.Method == "GET" {
+		s.serveAthlete(w)
+		return
+	}
+	if r.URL.Path == "/api/v3/uploads" && r.Method == "POST" {
+		s.createUpload(w, r)
+		return
+	}
+	if m := reUpload.FindStringSubmatch(r.URL.Path); m != nil && r.Method == "GET" {
+		s.serveUpload(w, m[1])
+		return
+	}
+	writeFault(w, http.StatusNotFound, "Record Not Found")
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	return auth == "Bearer "+s.token.AccessToken && time.Now().Unix() < s.token.ExpiresAt
+}
+
+func (s *Server) fault(w http.ResponseWriter, r *http.Request) bool {
+	for prefix, f := range s.faults {
+		if !strings.HasPrefix(r.URL.RequestURI(), prefix) {
+			continue
+		}
+		writeFault(w, f.StatusCode, f.Message)
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				delete(s.faults, prefix)
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// serveAuthorize immediately grants the requested scopes, as if the athlete
+// had clicked "Authorize", and redirects back with AuthCode.
+func (s *Server) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || q.Get("client_id") != strconv.Itoa(ClientId) || q.Get("response_type") != "code" {
+		writeFault(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	rq := redirect.Query()
+	rq.Set("state", q.Get("state"))
+	rq.Set("code", AuthCode)
+	rq.Set("scope", q.Get("scope"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeFault(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	if r.FormValue("client_id") != strconv.Itoa(ClientId) || r.FormValue("client_secret") != ClientSecret {
+		writeFault(w, http.StatusUnauthorized, "Authorization Error")
+		return
+	}
+	switch r.FormValue("grant_type") {
+	case "refresh_token":
+		if r.FormValue("refresh_token") != s.token.RefreshToken {
+			writeFault(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+		s.issueToken(time.Now().Add(tokenLifetime))
+		writeJSON(w, s.token)
+	case "authorization_code":
+		if r.FormValue("code") != AuthCode {
+			writeFault(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+		s.issueToken(time.Now().Add(tokenLifetime))
+		writeJSON(w, struct {
+			Token
+			Athlete strava.Athlete `json:"athlete"`
+		}{s.token, strava.Athlete{Id: s.athleteId, Firstname: "Test", Lastname: "Athlete"}})
+	default:
+		writeFault(w, http.StatusBadRequest, "Bad Request")
+	}
+}
+
+func (s *Server) serveActivities(w http.ResponseWriter, r *http.Request, athleteId string) {
+	if athleteId != strconv.FormatInt(s.athleteId, 10) {
+		writeFault(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+
+	q := r.URL.Query()
+	after, _ := strconv.ParseInt(q.Get("after"), 10, 64)
+	before, _ := strconv.ParseInt(q.Get("before"), 10, 64)
+	page, _ := strconv.Atoi(q.Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	perPage, _ := strconv.Atoi(q.Get("per_page"))
+	if perPage < 1 {
+		perPage = 30
+	}
+
+	matched := make(strava.Activities, 0)
+	for _, a := range s.activities {
+		t := a.StartDate.Unix()
+		if (after == 0 || t > after) && (before == 0 || t < before) {
+			matched = append(matched, a)
+		}
+	}
+	// Like Strava, return the newest activities first unless the caller is
+	// paging forward from a point in time.
+	if _, ok := q["after"]; !ok {
+		sort.Sort(sort.Reverse(matched))
+	}
+
+	start := (page - 1) * perPage
+	if start > len(matched) {
+		start = len(matched)
+	}
+	end := start + perPage
+	if end > len(matched) {
+		end = len(matched)
+	}
+	writeJSON(w, matched[start:end])
+}
+
+// findActivity returns the index of the activity with the given ID, or -1.
+// Must be called with the mutex held.
+func (s *Server) findActivity(id int64) int {
+	for i, a := range s.activities {
+		if a.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *Server) serveActivity(w http.ResponseWriter, rawId string) {
+	id, _ := strconv.ParseInt(rawId, 10, 64)
+	i := s.findActivity(id)
+	if i < 0 {
+		writeFault(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+	d := s.details[id]
+	d.Activity = s.activities[i]
+	writeJSON(w, d)
+}
+
+// updateActivity applies an UpdatableActivity, like Strava's PUT
+// /activities/{id}.
+func (s *Server) updateActivity(w http.ResponseWriter, r *http.Request, rawId string) {
+	id, _ := strconv.ParseInt(rawId, 10, 64)
+	i := s.findActivity(id)
+	if i < 0 {
+		writeFault(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+	var update strava.UpdatableActivity
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		writeFault(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	a := &s.activities[i]
+	d := s.details[id]
+	if update.Name != nil {
+		a.Name = *update.Name
+	}
+	if update.Type != nil {
+		a.Type = *update.Type
+	}
+	if update.GearId != nil {
+		a.GearId = *update.GearId
+		if a.GearId == strava.NoGear {
+			a.GearId = ""
+		} else if _, ok := s.gear[a.GearId]; !ok {
+			writeFault(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+	}
+	if update.Commute != nil {
+		a.Commute = *update.Commute
+	}
+	if update.Trainer != nil {
+		a.Trainer = *update.Trainer
+	}
+	if update.Description != nil {
+		d.Description = *update.Description
+	}
+	s.details[id] = d
+
+	updates := make(map[string]interface{})
+	if update.Name != nil {
+		updates["title"] = *update.Name
+	}
+	if update.Type != nil {
+		updates["type"] = *update.Type
+	}
+	s.queueEvent(strava.ObjectActivity, id, strava.AspectUpdate, updates)
+
+	d.Activity = *a
+	writeJSON(w, d)
+}
+
+func (s *Server) serveStreams(w http.ResponseWriter, r *http.Request, rawId string) {
+	id, _ := strconv.ParseInt(rawId, 10, 64)
+	streams, ok := s.streams[id]
+	if !ok || s.findActivity(id) < 0 {
+		writeFault(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+
+	// Return only the requested streams. Only key_by_type=true responses
+	// are supported.
+	data, _ := json.Marshal(streams)
+	all := make(map[string]json.RawMessage)
+	json.Unmarshal(data, &all)
+	selected := make(map[string]json.RawMessage)
+	for _, key := range strings.Split(r.URL.Query().Get("keys"), ",") {
+		if stream, ok := all[key]; ok {
+			selected[key] = stream
+		}
+	}
+	writeJSON(w, selected)
+}
+
+func (s *Server) serveGear(w http.ResponseWriter, id string) {
+	g, ok := s.gear[id]
+	if !ok {
+		writeFault(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+	writeJSON(w, g)
+}
+
+// serveAthlete returns the athlete with summaries of all their gear, sorted
+// by ID.
+func (s *Server) serveAthlete(w http.ResponseWriter) {
+	ids := make([]string, 0, len(s.gear))
+	for id := range s.gear {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	bikes, shoes := make([]strava.Gear, 0), make([]strava.Gear, 0)
+	for _, id := range ids {
+		g := s.gear[id]
+		summary := strava.Gear{Id: g.Id, Name: g.Name, Primary: g.Primary, Retired: g.Retired, Distance: g.Distance}
+		if g.IsBike() {
+			bikes = append(bikes, summary)
+		} else {
+			shoes = append(shoes, summary)
+		}
+	}
+	writeJSON(w, map[string]interface{}{
+		"id":        s.athleteId,
+		"firstname": "Test",
+		"lastname":  "Athlete",
+		"bikes":     bikes,
+		"shoes":     shoes,
+	})
+}
+
+const (
+	uploadProcessing = "Your activity is still being processed."
+	uploadReady      = "Your activity is ready."
+	uploadFailed     = "There was an error processing your activity."
+)
+
+// createUpload accepts an activity file like Strava's POST /uploads. The
+// file isn't parsed: the activity it becomes starts now, is a Ride and is
+// named after the name parameter or the file. Uploading the same file twice
+// fails as a duplicate.
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		writeFault(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		writeFault(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	switch r.FormValue("data_type") {
+	case "fit", "fit.gz", "tcx", "tcx.gz", "gpx", "gpx.gz":
+	default:
+		writeFault(w, http.StatusBadRequest, "Bad Request")
+		return
+	}
+
+	u := &upload{}
+	u.Id = int64(len(s.uploads) + 1)
+	u.ExternalId = r.FormValue("external_id")
+	u.Status = uploadProcessing
+	s.uploads = append(s.uploads, u)
+
+	sum := sha1.Sum(data)
+	if id, ok := s.uploaded[sum]; ok {
+		u.duplicateOf = id
+		writeJSON(w, u.Upload)
+		return
+	}
+
+	id := int64(1)
+	for _, a := range s.activities {
+		if a.Id >= id {
+			id = a.Id + 1
+		}
+	}
+	name := r.FormValue("name")
+	if name == "" {
+		name = strings.SplitN(header.Filename, ".", 2)[0]
+	}
+	start := time.Now().UTC().Truncate(time.Second)
+	u.activity = strava.Activity{
+		Id:             id,
+		Name:           name,
+		Type:           "Ride",
+		StartDate:      start,
+		StartDateLocal: start.Format("2006-01-02T15:04:05Z"),
+		ExternalId:     u.ExternalId,
+		Commute:        r.FormValue("commute") == "1",
+		Trainer:        r.FormValue("trainer") == "1",
+	}
+	s.uploaded[sum] = id
+	writeJSON(w, u.Upload)
+}
+
+func (s *Server) serveUpload(w http.ResponseWriter, rawId string) {
+	id, _ := strconv.ParseInt(rawId, 10, 64)
+	if id < 1 || id > int64(len(s.uploads)) {
+		writeFault(w, http.StatusNotFound, "Record Not Found")
+		return
+	}
+	u := s.uploads[id-1]
+	if !u.Done() {
+		if u.duplicateOf != 0 {
+			u.Status = uploadFailed
+			u.Error = fmt.Sprintf("%s duplicate of activity %d", u.ExternalId, u.duplicateOf)
+		} else {
+			u.Status = uploadReady
+			u.ActivityId = u.activity.Id
+			s.activities = append(s.activities, u.activity)
+			sort.Sort(s.activities)
+			s.queueEvent(strava.ObjectActivity, u.activity.Id, strava.AspectCreate, nil)
+		}
+	}
+	writeJSON(w, u.Upload)
+}
+
+// serveSubscriptions manages the webhook subscription like Strava's
+// /push_subscriptions. Creating a subscription validates the callback URL
+// first, releasing the mutex while it does.
+func (s *Server) serveSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("client_id") != strconv.Itoa(ClientId) || r.FormValue("client_secret") != ClientSecret {
+		writeFault(w, http.StatusUnauthorized, "Authorization Error")
+		return
+	}
+
+	switch {
+	case r.Method == "POST" && !reSubscription.MatchString(r.URL.Path):
+		if s.sub != nil {
+			writeFault(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+		// The callback may call back into the server, so validate it
+		// without the mutex.
+		callbackURL := r.FormValue("callback_url")
+		s.mutex.Unlock()
+		err := validateCallback(callbackURL, r.FormValue("verify_token"))
+		s.mutex.Lock()
+		if err != nil {
+			writeFault(w, http.StatusBadRequest, "Bad Request: "+err.Error())
+			return
+		}
+		if s.sub != nil {
+			writeFault(w, http.StatusBadRequest, "Bad Request")
+			return
+		}
+		now := time.Now().UTC().Truncate(time.Second)
+		s.subs++
+		s.sub = &strava.Subscription{
+			Id:            s.subs,
+			ApplicationId: ClientId,
+			CallbackURL:   callbackURL,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		writeJSON(w, map[string]int64{"id": s.sub.Id})
+	case r.Method == "GET" && !reSubscription.MatchString(r.URL.Path):
+		subs := make([]strava.Subscription, 0, 1)
+		if s.sub != nil {
+			subs = append(subs, *s.sub)
+		}
+		writeJSON(w, subs)
+	case r.Method == "DELETE" && reSubscription.MatchString(r.URL.Path):
+		m := reSubscription.FindStringSubmatch(r.URL.Path)
+		if s.sub == nil || m[1] != strconv.FormatInt(s.sub.Id, 10) {
+			writeFault(w, http.StatusNotFound, "Record Not Found")
+			return
+		}
+		s.sub = nil
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeFault(w, http.StatusNotFound, "Record Not Found")
+	}
+}
+
+// validateCallback makes the validation request Strava makes of a new
+// subscription's callback URL.
+func validateCallback(callbackURL, verifyToken string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	challenge := strconv.FormatInt(time.Now().UnixNano(), 36)
+	q := u.Query()
+	q.Set("hub.mode", "subscribe")
+	q.Set("hub.challenge", challenge)
+	q.Set("hub.verify_token", verifyToken)
+	u.RawQuery = q.Encode()
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var body map[string]string
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil || resp.StatusCode != http.StatusOK || body["hub.challenge"] != challenge {
+		return fmt.Errorf("callback url not verifiable")
+	}
+	return nil
+}
+
+// queueEvent queues an event for the webhook subscription, if any. Must be
+// called with the mutex held.
+func (s *Server) queueEvent(objectType string, id int64, aspect string, updates map[string]interface{}) {
+	if s.sub == nil {
+		return
+	}
+	if updates == nil {
+		updates = make(map[string]interface{})
+	}
+	s.deliver(delivery{s.sub.CallbackURL, strava.WebhookEvent{
+		ObjectType:     objectType,
+		ObjectId:       id,
+		AspectType:     aspect,
+		Updates:        updates,
+		OwnerId:        s.athleteId,
+		SubscriptionId: s.sub.Id,
+		EventTime:      time.Now().Unix(),
+	}})
+}
+
+// deliver queues an event for deliverEvents without blocking. Events sent
+// after Close are dropped. Must be called with the mutex held.
+func (s *Server) deliver(d delivery) {
+	if s.closed {
+		return
+	}
+	s.deliveries = append(s.deliveries, d)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverEvents posts queued events in order until the server is closed.
+// Like Strava, it tries each event up to three times.
+func (s *Server) deliverEvents() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		s.mutex.Lock()
+		deliveries := s.deliveries
+		s.deliveries = nil
+		s.mutex.Unlock()
+
+		for _, d := range deliveries {
+			body, _ := json.Marshal(d.event)
+			for attempt := 0; attempt < 3; attempt++ {
+				resp, err := http.Post(d.callbackURL, "application/json", bytes.NewReader(body))
+				if err == nil {
+					resp.Body.Close()
+					if resp.StatusCode == http.StatusOK {
+						break
+					}
+				}
+				select {
+				case <-s.done:
+					return
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+		}
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeFault(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": message,
+		"errors":  []interface{}{},
+	})
+}
@@ -0,0 +1,313 @@
+package stravatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/markdrayton/sls/strava"
+)
+
+const athleteId = 42
+
+func get(t *testing.T, srv *Server, path, accessToken string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("GET", srv.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func decode(t *testing.T, resp *http.Response, v interface{}) {
+	t.Helper()
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	err := json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func appForm(extra url.Values) url.Values {
+	form := url.Values{
+		"client_id":     {strconv.Itoa(ClientId)},
+		"client_secret": {ClientSecret},
+	}
+	for k, v := range extra {
+		form[k] = v
+	}
+	return form
+}
+
+func TestPaging(t *testing.T) {
+	srv := NewServer(athleteId)
+	defer srv.Close()
+	start := time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)
+	for i := 0; i < 75; i++ {
+		srv.AddActivities(strava.Activity{Id: int64(i + 1), StartDate: start.Add(time.Duration(i) * time.Hour)})
+	}
+	token := srv.Token().AccessToken
+
+	var ids []int64
+	for page := 1; ; page++ {
+		var activities strava.Activities
+		path := fmt.Sprintf("/api/v3/athletes/%d/activities?after=0&per_page=30&page=%d", athleteId, page)
+		decode(t, get(t, srv, path, token), &activities)
+		if want := []int{30, 30, 15, 0}[page-1]; len(activities) != want {
+			t.Fatalf("page %d has %d activities, want %d", page, len(activities), want)
+		}
+		if len(activities) == 0 {
+			break
+		}
+		for _, a := range activities {
+			ids = append(ids, a.Id)
+		}
+	}
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("activity %d is %d, want oldest first", i, id)
+		}
+	}
+
+	// Without after, the newest come first.
+	var activities strava.Activities
+	decode(t, get(t, srv, fmt.Sprintf("/api/v3/athletes/%d/activities?per_page=10", athleteId), token), &activities)
+	if len(activities) != 10 || activities[0].Id != 75 {
+		t.Errorf("got %d activities starting with %d, want 10 starting with 75", len(activities), activities[0].Id)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	srv := NewServer(athleteId)
+	defer srv.Close()
+	srv.AddGear(strava.Gear{Id: "b1", Name: "R3"})
+	srv.SetRateLimits(2, 10)
+	srv.SetRateUsage(0, 5)
+	token := srv.Token().AccessToken
+
+	for i, want := range []struct {
+		status int
+		usage  string
+	}{
+		{http.StatusOK, "1,6"},
+		{http.StatusOK, "2,7"},
+		{http.StatusTooManyRequests, "3,8"},
+	} {
+		resp := get(t, srv, "/api/v3/gear/b1", token)
+		resp.Body.Close()
+		if resp.StatusCode != want.status {
+			t.Errorf("request %d: status %d, want %d", i+1, resp.StatusCode, want.status)
+		}
+		if got := resp.Header.Get("X-RateLimit-Limit"); got != "2,10" {
+			t.Errorf("request %d: X-RateLimit-Limit %q, want \"2,10\"", i+1, got)
+		}
+		if got := resp.Header.Get("X-RateLimit-Usage"); got != want.usage {
+			t.Errorf("request %d: X-RateLimit-Usage %q, want %q", i+1, got, want.usage)
+		}
+	}
+	if got := srv.Requests(); got != 3 {
+		t.Errorf("Requests() = %d, want 3", got)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	srv := NewServer(athleteId)
+	defer srv.Close()
+	srv.AddGear(strava.Gear{Id: "b1", Name: "R3"})
+	old := srv.Token()
+
+	resp, err := http.PostForm(srv.URL+"/api/v3/oauth/token", appForm(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {"wrong"},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("refresh with a wrong token: status %d, want 400", resp.StatusCode)
+	}
+
+	resp, err = http.PostForm(srv.URL+"/api/v3/oauth/token", appForm(url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {old.RefreshToken},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fresh Token
+	decode(t, resp, &fresh)
+	if fresh.AccessToken == old.AccessToken || fresh.RefreshToken == old.RefreshToken {
+		t.Fatalf("refresh returned the old token %+v", fresh)
+	}
+	if fresh != srv.Token() {
+		t.Errorf("refresh returned %+v, server has %+v", fresh, srv.Token())
+	}
+
+	resp = get(t, srv, "/api/v3/gear/b1", old.AccessToken)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("old access token: status %d, want 401", resp.StatusCode)
+	}
+	var g strava.Gear
+	decode(t, get(t, srv, "/api/v3/gear/b1", fresh.AccessToken), &g)
+	if g.Name != "R3" {
+		t.Errorf("got gear %+v, want R3", g)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	srv := NewServer(athleteId)
+	defer srv.Close()
+	srv.AddGear(strava.Gear{Id: "b1", Name: "R3"})
+
+	status := func(token string) int {
+		resp := get(t, srv, "/api/v3/gear/b1", token)
+		defer resp.Body.Close()
+		var fault struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&fault)
+		if resp.StatusCode == http.StatusUnauthorized && fault.Message != "Authorization Error" {
+			t.Errorf("401 message %q, want \"Authorization Error\"", fault.Message)
+		}
+		return resp.StatusCode
+	}
+
+	if got := status(""); got != http.StatusUnauthorized {
+		t.Errorf("no token: status %d, want 401", got)
+	}
+	token := srv.Token()
+	if got := status(token.AccessToken); got != http.StatusOK {
+		t.Errorf("valid token: status %d, want 200", got)
+	}
+	srv.RevokeAccessToken()
+	if got := status(token.AccessToken); got != http.StatusUnauthorized {
+		t.Errorf("revoked token: status %d, want 401", got)
+	}
+	token = srv.Token()
+	srv.ExpireToken()
+	if got := status(token.AccessToken); got != http.StatusUnauthorized {
+		t.Errorf("expired token: status %d, want 401", got)
+	}
+}
+
+// A callback that calls the server while its subscription is being created
+// mustn't deadlock.
+func TestSubscribeCallbackUsesServer(t *testing.T) {
+	srv := NewServer(athleteId)
+	defer srv.Close()
+
+	events := make(chan strava.WebhookEvent, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			var e strava.WebhookEvent
+			json.NewDecoder(r.Body).Decode(&e)
+			events <- e
+			return
+		}
+		resp, err := http.Get(srv.URL + "/api/v3/push_subscriptions?" + appForm(nil).Encode())
+		if err == nil {
+			resp.Body.Close()
+		}
+		json.NewEncoder(w).Encode(map[string]string{"hub.challenge": r.FormValue("hub.challenge")})
+	}))
+	defer callback.Close()
+
+	done := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.PostForm(srv.URL+"/api/v3/push_subscriptions", appForm(url.Values{
+			"callback_url": {callback.URL},
+			"verify_token": {"token"},
+		}))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+	select {
+	case resp := <-done:
+		if resp == nil {
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("subscribe: status %d, want 200", resp.StatusCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribe deadlocked")
+	}
+
+	srv.SendEvent(strava.WebhookEvent{ObjectType: strava.ObjectActivity, ObjectId: 1, AspectType: strava.AspectCreate})
+	select {
+	case e := <-events:
+		if e.ObjectId != 1 || e.OwnerId != athleteId || e.SubscriptionId == 0 {
+			t.Errorf("got event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+}
+
+// Events queued faster than they're delivered, or after Close, mustn't
+// block or panic.
+func TestCloseWithQueuedEvents(t *testing.T) {
+	srv := NewServer(athleteId)
+
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			time.Sleep(10 * time.Millisecond)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"hub.challenge": r.FormValue("hub.challenge")})
+	}))
+	defer callback.Close()
+	resp, err := http.PostForm(srv.URL+"/api/v3/push_subscriptions", appForm(url.Values{
+		"callback_url": {callback.URL},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for i := 0; i < 2000; i++ {
+		srv.SendEvent(strava.WebhookEvent{ObjectType: strava.ObjectActivity, ObjectId: int64(i), AspectType: strava.AspectCreate})
+	}
+	srv.Close()
+	srv.SendEvent(strava.WebhookEvent{ObjectType: strava.ObjectActivity, ObjectId: 1, AspectType: strava.AspectCreate})
+	srv.Close()
+}
+
+func TestFault(t *testing.T) {
+	srv := NewServer(athleteId)
+	defer srv.Close()
+	srv.AddGear(strava.Gear{Id: "b1", Name: "R3"})
+	srv.Fail("/api/v3/gear/", Fault{StatusCode: http.StatusServiceUnavailable, Message: "down", Times: 1})
+	token := srv.Token().AccessToken
+
+	resp := get(t, srv, "/api/v3/gear/b1", token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", resp.StatusCode)
+	}
+	resp = get(t, srv, "/api/v3/gear/b1", token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("after the fault: status %d, want 200", resp.StatusCode)
+	}
+}